@@ -0,0 +1,429 @@
+package ast
+
+import "fmt"
+
+type Type uint
+type LiteralKind uint
+
+type Pos struct {
+	File string
+	Row  int
+	Col  int
+}
+
+type Node interface {
+	Position() Pos
+}
+
+const (
+	VOID Type = iota
+	INT
+	CHAR
+	BOOL
+	PTR
+	ANY
+)
+
+// MAX_RETURNS is the number of registers available to pass results back
+// from a procedure.
+const MAX_RETURNS = 6
+
+const (
+	INT_LIT LiteralKind = iota
+	BOOL_LIT
+	STRING_LIT
+	CHAR_LIT
+)
+
+// Program is the root of a parsed source file, every imported library is
+// parsed into its own Program and hangs off the Import node that pulled it in.
+type Program struct {
+	Pos
+	Body []Node
+}
+
+// Import references a library, Program is nil when the library was already
+// imported somewhere else in the compilation.
+type Import struct {
+	Pos
+	Path    string
+	Program *Program
+}
+
+type Arg struct {
+	Pos
+	Name string
+	Type Type
+}
+
+// Proc is a procedure definition, Declared is set when the signature lists
+// its results after `->`. Procedures without it keep the old convention of
+// returning whatever value is on top of the stack. Frame is the number of
+// 8 byte slots reserved below the base pointer for local variables.
+type Proc struct {
+	Pos
+	Name     string
+	Args     []Arg
+	Returns  []Type
+	Declared bool
+	Body     []Node
+	EndPos   Pos
+	Frame    int
+}
+
+// Buffer is a region of Size bytes in `.bss`, typed arrays set Type to the
+// element type and Count to the number of elements.
+type Buffer struct {
+	Pos
+	Name  string
+	Size  int
+	Type  Type
+	Count int
+}
+
+// Const is a named integer evaluated at compile time, uses of the name are
+// replaced by INT_LIT literals holding Value.
+type Const struct {
+	Pos
+	Name  string
+	Value int64
+}
+
+// Var is a global variable, it lives in `.data` when HasInit is set and in
+// `.bss` otherwise.
+type Var struct {
+	Pos
+	Name    string
+	Type    Type
+	HasInit bool
+	Init    int64
+}
+
+// Macro is a named sequence of tokens, every use of the name is parsed again
+// from the tokens and replaced by an Expansion.
+type Macro struct {
+	Pos
+	Name   string
+	EndPos Pos
+}
+
+// Expansion holds the instructions produced by using a macro at Pos, the
+// nodes inside keep the positions of the macro definition.
+type Expansion struct {
+	Pos
+	Macro *Macro
+	Body  []Node
+}
+
+// Struct is a record layout, fields are placed at their natural alignment
+// the same way a C compiler lays them out so kernel structures can be
+// described directly.
+type Struct struct {
+	Pos
+	Name   string
+	Fields []*Field
+	Size   int
+	Align  int
+}
+
+// Field is a member of a struct, Struct is set for embedded structs and
+// Count for arrays. Only scalar fields can be loaded and stored directly,
+// Width is the size of one element in bytes which lets `u16` and `u32`
+// fields hold an int in 2 or 4 bytes.
+type Field struct {
+	Pos
+	Name   string
+	Type   Type
+	Width  int
+	Struct *Struct
+	Count  int
+	Offset int
+}
+
+// Let pops the top values of the stack into the named locals which are
+// visible until the matching `end`.
+type Let struct {
+	Pos
+	Locals []*Local
+	Body   []Node
+	EndPos Pos
+}
+
+// Local is a variable living in stack frame slot Slot of its procedure.
+type Local struct {
+	Pos
+	Name string
+	Slot int
+}
+
+// If runs Then when the popped condition is true and Else otherwise. An
+// `elif` is stored as an If with Elif set at the end of the Else branch of
+// the previous one, right after its condition.
+type If struct {
+	Pos
+	Then    []Node
+	Else    []Node
+	HasElse bool
+	Elif    bool
+	ElsePos Pos
+	EndPos  Pos
+}
+
+type While struct {
+	Pos
+	Cond   []Node
+	Body   []Node
+	DoPos  Pos
+	EndPos Pos
+}
+
+// Asm is a block of assembly emitted verbatim, the inputs are popped into the
+// registers used for procedure results before it runs and the outputs are
+// pushed from them afterwards.
+type Asm struct {
+	Pos
+	Args    []Type
+	Returns []Type
+	Code    []string
+}
+
+// For counts Var from the first value pushed by Bounds up to, but not
+// including, the second one, adding Step after every iteration. The limit is
+// kept in the hidden local End so it is evaluated only once.
+type For struct {
+	Pos
+	Var    *Local
+	End    *Local
+	Bounds []Node
+	Step   int64
+	DoPos  Pos
+	Body   []Node
+	EndPos Pos
+}
+
+// Match pops a value and runs the body of the case with the same value, or
+// Default when there is none.
+type Match struct {
+	Pos
+	Cases      []*Case
+	Default    []Node
+	HasDefault bool
+	DefaultPos Pos
+	EndPos     Pos
+}
+
+type Case struct {
+	Pos
+	Value int64
+	Body  []Node
+}
+
+// Break jumps past the end of the innermost loop.
+type Break struct {
+	Pos
+	Loop Node
+}
+
+// Continue jumps to the next iteration of the innermost loop.
+type Continue struct {
+	Pos
+	Loop Node
+}
+
+type Literal struct {
+	Pos
+	Kind  LiteralKind
+	Value string
+}
+
+type Operator struct {
+	Pos
+	Op string
+}
+
+// Keyword is a builtin stack operation such as `dup`, `swap` or `derefc`.
+type Keyword struct {
+	Pos
+	Name string
+}
+
+type Return struct {
+	Pos
+}
+
+type Syscall struct {
+	Pos
+	Argc int
+}
+
+type Call struct {
+	Pos
+	Name string
+	Proc *Proc
+}
+
+type BufferRef struct {
+	Pos
+	Name   string
+	Buffer *Buffer
+}
+
+// VarRef pushes the address of a global variable.
+type VarRef struct {
+	Pos
+	Var *Var
+}
+
+// VarLoad pushes the value of a global variable, `name @`.
+type VarLoad struct {
+	Pos
+	Var *Var
+}
+
+// VarStore pops the top value into a global variable, `value name :=`.
+type VarStore struct {
+	Pos
+	Var *Var
+}
+
+// FieldLoad pops a pointer to a struct and pushes the field found Offset
+// bytes past it, `ptr Name.field @`.
+type FieldLoad struct {
+	Pos
+	Name   string
+	Field  *Field
+	Offset int
+}
+
+// FieldStore pops a pointer and a value and stores the value into the field,
+// `ptr value Name.field :=`.
+type FieldStore struct {
+	Pos
+	Name   string
+	Field  *Field
+	Offset int
+}
+
+// Index pops an array pointer and an index and pushes the element,
+// `array i []`. Array is set by the checker from the pointer operand.
+type Index struct {
+	Pos
+	Array *Buffer
+}
+
+// IndexStore pops an array pointer, an index and a value and stores the value
+// into the element, `array i value []=`.
+type IndexStore struct {
+	Pos
+	Array *Buffer
+}
+
+type LocalRef struct {
+	Pos
+	Local *Local
+}
+
+// LocalStore pops the top value into a local, `value name :=`.
+type LocalStore struct {
+	Pos
+	Local *Local
+}
+
+// ArgStore pops the top value into the argument at Index, `value name :=`.
+type ArgStore struct {
+	Pos
+	Name  string
+	Index int
+}
+
+// ArgRef reads the argument at Index of the enclosing procedure.
+type ArgRef struct {
+	Pos
+	Name  string
+	Index int
+}
+
+func (p Pos) Position() Pos {
+	return p
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d %s", p.Row, p.Col, p.File)
+}
+
+func (t Type) String() string {
+	switch t {
+	case INT:
+		return "int"
+	case CHAR:
+		return "char"
+	case BOOL:
+		return "bool"
+	case PTR:
+		return "ptr"
+	case ANY:
+		return "any"
+	}
+	return "void"
+}
+
+// Size is the number of bytes a value of the type occupies in memory.
+func (t Type) Size() int {
+	switch t {
+	case CHAR, BOOL:
+		return 1
+	}
+	return 8
+}
+
+// FieldType returns the type and width in bytes of a builtin field type,
+// `u16` and `u32` are unsigned integers narrower than `int`.
+func FieldType(name string) (Type, int) {
+	switch name {
+	case "u16":
+		return INT, 2
+	case "u32":
+		return INT, 4
+	}
+	kind := ParseType(name)
+	return kind, kind.Size()
+}
+
+// Scalar reports whether the field holds a single value of a builtin type.
+func (f *Field) Scalar() bool {
+	return f.Struct == nil && f.Count == 0
+}
+
+// Find returns the field with the given name.
+func (s *Struct) Find(name string) (*Field, bool) {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return nil, false
+}
+
+func ParseType(name string) Type {
+	switch name {
+	case "int":
+		return INT
+	case "char":
+		return CHAR
+	case "bool":
+		return BOOL
+	case "ptr":
+		return PTR
+	}
+	return VOID
+}
+
+// ArgIndex returns the position of the named argument in the signature.
+func (p *Proc) ArgIndex(name string) (int, bool) {
+	for i, arg := range p.Args {
+		if arg.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
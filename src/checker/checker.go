@@ -0,0 +1,609 @@
+package checker
+
+import (
+	"strings"
+	"xyl/src/ast"
+	"xyl/src/diag"
+)
+
+type Stack []ast.Type
+
+// Checker simulates the types on the data stack through every procedure,
+// once a `return` is reached the rest of the block is unreachable and is
+// not taken into account when branches are merged. Next to every value it
+// keeps the typed array it was pushed from, which `[]` and `[]=` bind to.
+type Checker struct {
+	Diagnostics diag.Diagnostics
+	stack       Stack
+	arrays      []*ast.Buffer
+	dead        bool
+	proc        *ast.Proc
+	locals      map[*ast.Local]ast.Type
+	expansions  []*ast.Expansion
+	loops       map[ast.Node]Stack
+}
+
+func (s Stack) String() string {
+	names := make([]string, len(s))
+	for i, t := range s {
+		names[i] = t.String()
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+func (s Stack) Copy() Stack {
+	return append(Stack{}, s...)
+}
+
+func (s Stack) Equal(other Stack) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for i := range s {
+		if s[i] != other[i] && s[i] != ast.ANY && other[i] != ast.ANY {
+			return false
+		}
+	}
+	return true
+}
+
+// Accepts reports whether a value of type got can be used where want is
+// expected, chars widen to ints and `any` matches everything.
+func Accepts(want, got ast.Type) bool {
+	return want == got || want == ast.ANY || got == ast.ANY || (want == ast.INT && got == ast.CHAR)
+}
+
+func numeric(t ast.Type) bool {
+	return t == ast.INT || t == ast.CHAR || t == ast.ANY
+}
+
+func pointer(t ast.Type) bool {
+	return t == ast.PTR || t == ast.ANY
+}
+
+func Check(prog *ast.Program) diag.Diagnostics {
+	c := &Checker{Diagnostics: diag.Diagnostics{}, locals: make(map[*ast.Local]ast.Type), loops: make(map[ast.Node]Stack)}
+	c.Program(prog)
+	return c.Diagnostics
+}
+
+func (c *Checker) Error(pos ast.Pos, format string, a ...any) {
+	c.Report(diag.New(diag.ERROR, pos.File, pos.Row, pos.Col, format, a...))
+}
+
+// Report records a diagnostic, inside macro expansions the expansion sites
+// are attached as notes.
+func (c *Checker) Report(d diag.Diagnostic) {
+	for i := len(c.expansions) - 1; i >= 0; i-- {
+		site := c.expansions[i]
+		d = d.WithNote(site.File, site.Row, site.Col, "In expansion of macro `%s`", site.Macro.Name)
+	}
+	c.Diagnostics.Add(d)
+}
+
+func (c *Checker) Push(types ...ast.Type) {
+	c.stack = append(c.stack, types...)
+	c.arrays = append(c.arrays, make([]*ast.Buffer, len(types))...)
+}
+
+// Array returns the typed array the nth value from the top was pushed from,
+// nil for any other value.
+func (c *Checker) Array(n int) *ast.Buffer {
+	if len(c.arrays) < n {
+		return nil
+	}
+	return c.arrays[len(c.arrays)-n]
+}
+
+// mergeArrays keeps the arrays both branches agree on, the stacks are
+// expected to have the same length.
+func mergeArrays(a, b []*ast.Buffer) []*ast.Buffer {
+	merged := make([]*ast.Buffer, len(a))
+	for i := range merged {
+		if i < len(b) && a[i] == b[i] {
+			merged[i] = a[i]
+		}
+	}
+	return merged
+}
+
+// Pop removes n values from the stack, missing values are reported and
+// replaced by `any` so the simulation can carry on.
+func (c *Checker) Pop(pos ast.Pos, name string, n int) Stack {
+	if len(c.stack) < n {
+		c.Error(pos, "Not enough values on the stack for `%s` : expected %d got %d", name, n, len(c.stack))
+		missing := make(Stack, n-len(c.stack))
+		for i := range missing {
+			missing[i] = ast.ANY
+		}
+		c.stack = append(missing, c.stack...)
+		c.arrays = append(make([]*ast.Buffer, len(missing)), c.arrays...)
+	}
+	values := c.stack[len(c.stack)-n:].Copy()
+	c.stack = c.stack[:len(c.stack)-n]
+	c.arrays = c.arrays[:len(c.arrays)-n]
+	return values
+}
+
+func (c *Checker) Expect(pos ast.Pos, name string, want, got ast.Type) {
+	if !Accepts(want, got) {
+		c.Error(pos, "`%s` expects %s got %s", name, want, got)
+	}
+}
+
+func (c *Checker) Program(prog *ast.Program) {
+	c.stack, c.arrays = Stack{}, nil
+	c.dead = false
+	for _, node := range prog.Body {
+		switch node := node.(type) {
+		case *ast.Import:
+			if node.Program != nil {
+				c.Program(node.Program)
+			}
+		case *ast.Proc:
+			c.Proc(node)
+		default:
+			c.Node(node)
+		}
+	}
+}
+
+func (c *Checker) Proc(proc *ast.Proc) {
+	if proc.Name == "main" && proc.Declared && !(len(proc.Returns) == 0 || len(proc.Returns) == 1 && proc.Returns[0] == ast.INT) {
+		c.Error(proc.Pos, "Procedure `main` must return `int` or `void`")
+	}
+	c.proc = proc
+	c.stack, c.arrays = Stack{}, nil
+	c.dead = false
+	c.Block(proc.Body)
+	if !c.dead {
+		c.Returns(proc.EndPos, "end")
+	}
+	c.proc = nil
+	c.stack, c.arrays = Stack{}, nil
+	c.dead = false
+}
+
+func (c *Checker) Block(nodes []ast.Node) {
+	for i, node := range nodes {
+		if c.dead {
+			c.Unreachable(nodes[i:])
+			return
+		}
+		c.Node(node)
+	}
+}
+
+// Unreachable walks code after a `return`, `break` or `continue` on a
+// throwaway stack without reporting anything, `[]` and `[]=` in it still
+// have to be bound to their arrays for the code generator.
+func (c *Checker) Unreachable(nodes []ast.Node) {
+	diagnostics, stack, arrays := c.Diagnostics, c.stack, c.arrays
+	c.stack, c.arrays, c.dead = Stack{}, nil, false
+	c.Block(nodes)
+	c.Diagnostics, c.stack, c.arrays, c.dead = diagnostics, stack, arrays, true
+}
+
+func (c *Checker) Node(node ast.Node) {
+	pos := node.Position()
+	switch node := node.(type) {
+	case *ast.If:
+		c.If(node)
+	case *ast.While:
+		c.While(node)
+	case *ast.Literal:
+		switch node.Kind {
+		case ast.INT_LIT:
+			c.Push(ast.INT)
+		case ast.BOOL_LIT:
+			c.Push(ast.BOOL)
+		case ast.STRING_LIT:
+			c.Push(ast.PTR)
+		case ast.CHAR_LIT:
+			c.Push(ast.CHAR)
+		}
+	case *ast.Operator:
+		c.Operator(node)
+	case *ast.Keyword:
+		c.Keyword(node)
+	case *ast.Return:
+		if c.proc != nil {
+			c.Returns(pos, "return")
+		} else {
+			c.Pop(pos, "return", 1)
+		}
+		c.dead = true
+	case *ast.Syscall:
+		c.Pop(pos, "syscall", node.Argc)
+		c.Push(ast.INT)
+	case *ast.Call:
+		args := c.Pop(pos, node.Name, len(node.Proc.Args))
+		for i, arg := range node.Proc.Args {
+			if !Accepts(arg.Type, args[i]) {
+				c.Error(pos, "Argument `%s` of `%s` expects %s got %s", arg.Name, node.Name, arg.Type, args[i])
+			}
+		}
+		if node.Proc.Declared {
+			c.Push(node.Proc.Returns...)
+		} else {
+			c.Push(ast.ANY)
+		}
+	case *ast.BufferRef:
+		c.Push(ast.PTR)
+		if node.Buffer.Type != ast.VOID {
+			c.arrays[len(c.arrays)-1] = node.Buffer
+		}
+	case *ast.VarRef:
+		c.Push(ast.PTR)
+	case *ast.VarLoad:
+		c.Push(node.Var.Type)
+	case *ast.VarStore:
+		value := c.Pop(pos, node.Var.Name, 1)
+		if !Accepts(node.Var.Type, value[0]) && !(node.Var.Type == ast.CHAR && numeric(value[0])) {
+			c.Error(pos, "Variable `%s` of type %s can not store %s", node.Var.Name, node.Var.Type, value[0])
+		}
+	case *ast.Index:
+		node.Array = c.Array(2)
+		values := c.Pop(pos, "[]", 2)
+		c.Expect(pos, "[]", ast.PTR, values[0])
+		c.Expect(pos, "[]", ast.INT, values[1])
+		if node.Array == nil {
+			c.Error(pos, "The pointer of `[]` must be the name of a typed array")
+			c.Push(ast.ANY)
+		} else {
+			c.Push(node.Array.Type)
+		}
+	case *ast.IndexStore:
+		node.Array = c.Array(3)
+		values := c.Pop(pos, "[]=", 3)
+		c.Expect(pos, "[]=", ast.PTR, values[0])
+		c.Expect(pos, "[]=", ast.INT, values[1])
+		if node.Array == nil {
+			c.Error(pos, "The pointer of `[]=` must be the name of a typed array")
+		} else if !Accepts(node.Array.Type, values[2]) && !(node.Array.Type == ast.CHAR && numeric(values[2])) {
+			c.Error(pos, "Array `%s` of %s can not store %s", node.Array.Name, node.Array.Type, values[2])
+		}
+	case *ast.For:
+		c.For(node)
+	case *ast.Match:
+		c.Match(node)
+	case *ast.Break:
+		c.Jump(pos, "break", node.Loop)
+	case *ast.Continue:
+		c.Jump(pos, "continue", node.Loop)
+	case *ast.Asm:
+		values := c.Pop(pos, "asm", len(node.Args))
+		for i, want := range node.Args {
+			c.Expect(pos, "asm", want, values[i])
+		}
+		c.Push(node.Returns...)
+	case *ast.Expansion:
+		c.expansions = append(c.expansions, node)
+		c.Block(node.Body)
+		c.expansions = c.expansions[:len(c.expansions)-1]
+	case *ast.FieldLoad:
+		c.Expect(pos, node.Name, ast.PTR, c.Pop(pos, node.Name, 1)[0])
+		c.Push(node.Field.Type)
+	case *ast.FieldStore:
+		values := c.Pop(pos, node.Name, 2)
+		c.Expect(pos, node.Name, ast.PTR, values[0])
+		if !Accepts(node.Field.Type, values[1]) && !(node.Field.Type == ast.CHAR && numeric(values[1])) {
+			c.Error(pos, "Field `%s` of type %s can not store %s", node.Name, node.Field.Type, values[1])
+		}
+	case *ast.ArgRef:
+		c.Push(c.proc.Args[node.Index].Type)
+	case *ast.ArgStore:
+		arg := c.proc.Args[node.Index]
+		value := c.Pop(pos, node.Name, 1)
+		if !Accepts(arg.Type, value[0]) {
+			c.Error(pos, "Argument `%s` of type %s can not store %s", arg.Name, arg.Type, value[0])
+		}
+	case *ast.Let:
+		values := c.Pop(pos, "let", len(node.Locals))
+		for i, local := range node.Locals {
+			c.locals[local] = values[i]
+		}
+		c.Block(node.Body)
+	case *ast.LocalRef:
+		c.Push(c.locals[node.Local])
+	case *ast.LocalStore:
+		want := c.locals[node.Local]
+		value := c.Pop(pos, node.Local.Name, 1)
+		if !Accepts(want, value[0]) {
+			c.Error(pos, "Local `%s` of type %s can not store %s", node.Local.Name, want, value[0])
+		}
+	}
+}
+
+// Returns checks that the stack holds exactly the declared results of the
+// current procedure when it is left through `return` or `end`, procedures
+// without `->` have to leave exactly one value.
+func (c *Checker) Returns(pos ast.Pos, name string) {
+	want := Stack(c.proc.Returns)
+	if !c.proc.Declared {
+		want = Stack{ast.ANY}
+	}
+	ok := len(c.stack) == len(want)
+	for i := 0; ok && i < len(want); i++ {
+		ok = Accepts(want[i], c.stack[i])
+	}
+	if !ok {
+		d := diag.New(diag.ERROR, pos.File, pos.Row, pos.Col, "`%s` of procedure `%s` expects the stack %s got %s", name, c.proc.Name, want, c.stack)
+		c.Report(d.WithNote(c.proc.File, c.proc.Row, c.proc.Col, "`%s` is declared here", c.proc.Name))
+	}
+}
+
+func (c *Checker) If(node *ast.If) {
+	name := "if"
+	if node.Elif {
+		name = "elif"
+	}
+	cond := c.Pop(node.Pos, name, 1)
+	c.Expect(node.Pos, name, ast.BOOL, cond[0])
+
+	entry, entryArrays := c.stack.Copy(), append([]*ast.Buffer{}, c.arrays...)
+	c.Block(node.Then)
+	then, thenArrays, thenDead := c.stack, c.arrays, c.dead
+
+	c.stack, c.arrays, c.dead = entry, entryArrays, false
+	c.Block(node.Else)
+	other, otherDead := c.stack, c.dead
+
+	switch {
+	case thenDead && otherDead:
+		c.dead = true
+	case thenDead:
+		c.stack = other
+	case otherDead:
+		c.stack, c.arrays = then, thenArrays
+	case then.Equal(other):
+		c.arrays = mergeArrays(c.arrays, thenArrays)
+	default:
+		if node.HasElse {
+			d := diag.New(diag.ERROR, node.EndPos.File, node.EndPos.Row, node.EndPos.Col, "Branches of `%s` leave different stacks : %s and %s", name, then, other)
+			c.Report(d.WithNote(node.ElsePos.File, node.ElsePos.Row, node.ElsePos.Col, "`%s` branch ends here with %s", name, then))
+		} else {
+			d := diag.New(diag.ERROR, node.EndPos.File, node.EndPos.Row, node.EndPos.Col, "`%s` without `else` must not change the stack : %s became %s", name, entry, then)
+			c.Report(d.WithNote(node.File, node.Row, node.Col, "`%s` starts here", name))
+		}
+		c.stack, c.arrays = then, thenArrays
+	}
+}
+
+func (c *Checker) While(node *ast.While) {
+	entry := c.stack.Copy()
+	c.Block(node.Cond)
+	if c.dead {
+		c.Unreachable(node.Body)
+		return
+	}
+
+	cond := c.Pop(node.DoPos, "do", 1)
+	c.Expect(node.DoPos, "do", ast.BOOL, cond[0])
+	if !c.stack.Equal(entry) {
+		c.Error(node.DoPos, "Condition of `while` must only push a bool : %s became %s", entry, c.stack)
+	}
+
+	exit := c.stack.Copy()
+	c.loops[node] = entry
+	c.Block(node.Body)
+	if !c.dead && !c.stack.Equal(entry) {
+		d := diag.New(diag.ERROR, node.EndPos.File, node.EndPos.Row, node.EndPos.Col, "Body of `while` must not change the stack : %s became %s", entry, c.stack)
+		c.Report(d.WithNote(node.File, node.Row, node.Col, "`while` starts here"))
+	}
+	c.stack, c.arrays, c.dead = exit, make([]*ast.Buffer, len(exit)), false
+}
+
+func (c *Checker) For(node *ast.For) {
+	entry := c.stack.Copy()
+	c.Block(node.Bounds)
+	if c.dead {
+		c.Unreachable(node.Body)
+		return
+	}
+
+	bounds := c.Pop(node.DoPos, "for", 2)
+	c.Expect(node.DoPos, "for", ast.INT, bounds[0])
+	c.Expect(node.DoPos, "for", ast.INT, bounds[1])
+	if !c.stack.Equal(entry) {
+		c.Error(node.DoPos, "Bounds of `for` must only push two ints : %s became %s", entry, c.stack)
+	}
+
+	exit := c.stack.Copy()
+	c.locals[node.End] = ast.INT
+	c.locals[node.Var] = ast.INT
+	c.loops[node] = exit
+	c.Block(node.Body)
+	if !c.dead && !c.stack.Equal(exit) {
+		d := diag.New(diag.ERROR, node.EndPos.File, node.EndPos.Row, node.EndPos.Col, "Body of `for` must not change the stack : %s became %s", exit, c.stack)
+		c.Report(d.WithNote(node.File, node.Row, node.Col, "`for` starts here"))
+	}
+	c.stack, c.arrays, c.dead = exit, make([]*ast.Buffer, len(exit)), false
+}
+
+// Match checks every case from the stack left after popping the value, all
+// branches which don't return have to leave the same stack. Without a
+// `default` the stack is left unchanged for unhandled values.
+func (c *Checker) Match(node *ast.Match) {
+	value := c.Pop(node.Pos, "match", 1)
+	c.Expect(node.Pos, "match", ast.INT, value[0])
+
+	entry, entryArrays := c.stack.Copy(), append([]*ast.Buffer{}, c.arrays...)
+	var result Stack
+	var resultArrays []*ast.Buffer
+	var resultPos ast.Pos
+	live := false
+	branch := func(pos ast.Pos, body []ast.Node) {
+		c.stack, c.arrays, c.dead = entry.Copy(), append([]*ast.Buffer{}, entryArrays...), false
+		c.Block(body)
+		if c.dead {
+			return
+		}
+		if !live {
+			result, resultArrays, resultPos, live = c.stack, c.arrays, pos, true
+			return
+		}
+		resultArrays = mergeArrays(resultArrays, c.arrays)
+		if !c.stack.Equal(result) {
+			d := diag.New(diag.ERROR, pos.File, pos.Row, pos.Col, "Branches of `match` leave different stacks : %s and %s", result, c.stack)
+			c.Report(d.WithNote(resultPos.File, resultPos.Row, resultPos.Col, "This branch leaves %s", result))
+		}
+	}
+
+	for _, cs := range node.Cases {
+		branch(cs.Pos, cs.Body)
+	}
+	if node.HasDefault {
+		branch(node.DefaultPos, node.Default)
+	} else {
+		branch(node.EndPos, nil)
+	}
+	c.stack, c.arrays, c.dead = result, resultArrays, !live
+}
+
+// Jump checks `break` and `continue`, both leave the loop body so the stack
+// has to match the one the loop started with.
+func (c *Checker) Jump(pos ast.Pos, name string, loop ast.Node) {
+	if entry := c.loops[loop]; !c.stack.Equal(entry) {
+		start := loop.Position()
+		d := diag.New(diag.ERROR, pos.File, pos.Row, pos.Col, "`%s` must leave the stack as it was before the loop : %s became %s", name, entry, c.stack)
+		c.Report(d.WithNote(start.File, start.Row, start.Col, "Loop starts here"))
+	}
+	c.dead = true
+}
+
+func (c *Checker) Operator(node *ast.Operator) {
+	if node.Op == "~" {
+		value := c.Pop(node.Pos, node.Op, 1)
+		if !numeric(value[0]) {
+			c.Error(node.Pos, "Invalid operand type for `~` : %s", value[0])
+		}
+		c.Push(ast.INT)
+		return
+	}
+
+	values := c.Pop(node.Pos, node.Op, 2)
+	a, b := values[0], values[1]
+	invalid := func() {
+		c.Error(node.Pos, "Invalid operand types for `%s` : %s and %s", node.Op, a, b)
+	}
+
+	switch node.Op {
+	case "+":
+		switch {
+		case a == ast.PTR && numeric(b), numeric(a) && b == ast.PTR:
+			c.Push(ast.PTR)
+		case a == ast.ANY || b == ast.ANY:
+			c.Push(ast.ANY)
+		case numeric(a) && numeric(b):
+			c.Push(ast.INT)
+		default:
+			invalid()
+			c.Push(ast.INT)
+		}
+	case "-":
+		switch {
+		case a == ast.PTR && numeric(b) && b != ast.ANY:
+			c.Push(ast.PTR)
+		case pointer(a) && pointer(b) && (a == ast.PTR || b == ast.PTR):
+			c.Push(ast.INT)
+		case a == ast.ANY || b == ast.ANY:
+			c.Push(ast.ANY)
+		case numeric(a) && numeric(b):
+			c.Push(ast.INT)
+		default:
+			invalid()
+			c.Push(ast.INT)
+		}
+	case "*", "/", "%":
+		if !numeric(a) || !numeric(b) {
+			invalid()
+		}
+		c.Push(ast.INT)
+	case "&", "|", "^":
+		switch {
+		case a == ast.BOOL && b == ast.BOOL:
+			c.Push(ast.BOOL)
+		case numeric(a) && numeric(b):
+			c.Push(ast.INT)
+		default:
+			invalid()
+			c.Push(ast.INT)
+		}
+	case "<<", ">>", ">>>":
+		if !numeric(a) || !numeric(b) {
+			invalid()
+		}
+		c.Push(ast.INT)
+	case "=", "!", "!=":
+		if !Accepts(a, b) && !Accepts(b, a) {
+			invalid()
+		}
+		c.Push(ast.BOOL)
+	case "<", ">", "<=", ">=":
+		if !(numeric(a) && numeric(b)) && !(pointer(a) && pointer(b)) {
+			invalid()
+		}
+		c.Push(ast.BOOL)
+	}
+}
+
+func (c *Checker) Keyword(node *ast.Keyword) {
+	switch node.Name {
+	case "dup":
+		array := c.Array(1)
+		value := c.Pop(node.Pos, node.Name, 1)
+		c.Push(value[0], value[0])
+		c.arrays[len(c.arrays)-2], c.arrays[len(c.arrays)-1] = array, array
+	case "drop":
+		c.Pop(node.Pos, node.Name, 1)
+	case "swap":
+		a, b := c.Array(2), c.Array(1)
+		values := c.Pop(node.Pos, node.Name, 2)
+		c.Push(values[1], values[0])
+		c.arrays[len(c.arrays)-2], c.arrays[len(c.arrays)-1] = b, a
+	case "inc", "dec":
+		value := c.Pop(node.Pos, node.Name, 1)
+		if !numeric(value[0]) && value[0] != ast.PTR {
+			c.Error(node.Pos, "`%s` expects int, char or ptr got %s", node.Name, value[0])
+		}
+		c.Push(value[0])
+	case "dump":
+		c.Pop(node.Pos, node.Name, 1)
+	case "neg":
+		value := c.Pop(node.Pos, node.Name, 1)
+		if !numeric(value[0]) {
+			c.Error(node.Pos, "`neg` expects int or char got %s", value[0])
+		}
+		c.Push(ast.INT)
+	case "and", "or":
+		values := c.Pop(node.Pos, node.Name, 2)
+		c.Expect(node.Pos, node.Name, ast.BOOL, values[0])
+		c.Expect(node.Pos, node.Name, ast.BOOL, values[1])
+		c.Push(ast.BOOL)
+	case "not":
+		value := c.Pop(node.Pos, node.Name, 1)
+		c.Expect(node.Pos, node.Name, ast.BOOL, value[0])
+		c.Push(ast.BOOL)
+	case "divmod":
+		values := c.Pop(node.Pos, node.Name, 2)
+		if !numeric(values[0]) || !numeric(values[1]) {
+			c.Error(node.Pos, "Invalid operand types for `%s` : %s and %s", node.Name, values[0], values[1])
+		}
+		c.Push(ast.INT, ast.INT)
+	case "derefc":
+		value := c.Pop(node.Pos, node.Name, 1)
+		c.Expect(node.Pos, node.Name, ast.PTR, value[0])
+		c.Push(ast.CHAR)
+	case "derefw", "derefd", "derefi":
+		value := c.Pop(node.Pos, node.Name, 1)
+		c.Expect(node.Pos, node.Name, ast.PTR, value[0])
+		c.Push(ast.INT)
+	case "storec", "storew", "stored", "storei":
+		values := c.Pop(node.Pos, node.Name, 2)
+		c.Expect(node.Pos, node.Name, ast.PTR, values[0])
+		if values[1] == ast.PTR && node.Name != "storei" {
+			c.Error(node.Pos, "`%s` can not store a ptr, use `storei`", node.Name)
+		}
+	}
+}
@@ -0,0 +1,748 @@
+package codegen
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"xyl/src/ast"
+)
+
+const (
+	printNumText = `dump:
+  testq %rdi, %rdi
+  jns .L1
+  pushq %rdi
+  pushq $45
+  movq $1, %rax
+  movq $1, %rdi
+  movq %rsp, %rsi
+  movq $1, %rdx
+  syscall
+  popq %rax
+  popq %rdi
+  negq %rdi
+.L1:
+  pushq %rbp
+  movq %rsp, %rbp
+  subq $64, %rsp
+  movq %rdi, -56(%rbp)
+  movq $1, -8(%rbp)
+  movl $32, %eax
+  subq -8(%rbp), %rax
+  movb $10, -48(%rbp,%rax)
+.L2:
+  movq -56(%rbp), %rcx
+  movabsq $-3689348814741910323, %rdx
+  movq %rcx, %rax
+  mulq %rdx
+  shrq $3, %rdx
+  movq %rdx, %rax
+  salq $2, %rax
+  addq %rdx, %rax
+  addq %rax, %rax
+  subq %rax, %rcx
+  movq %rcx, %rdx
+  movl %edx, %eax
+  leal 48(%rax), %edx
+  movl $31, %eax
+  subq -8(%rbp), %rax
+  movb %dl, -48(%rbp,%rax)
+  addq $1, -8(%rbp)
+  movq -56(%rbp), %rax
+  movabsq $-3689348814741910323, %rdx
+  mulq %rdx
+  movq %rdx, %rax
+  shrq $3, %rax
+  movq %rax, -56(%rbp)
+  cmpq $0, -56(%rbp)
+  jne .L2
+  movl $32, %eax
+  subq -8(%rbp), %rax
+  leaq -48(%rbp), %rdx
+  leaq (%rdx,%rax), %rcx
+  movq -8(%rbp), %rax
+  movq %rax, %rdx
+  movq %rcx, %rsi
+  movl $1, %edi
+  movl $0, %eax
+  movq $1,%rax
+  syscall
+  nop
+  leave
+  ret`
+)
+
+var registers = []string{"rax", "rdi", "rsi", "rdx", "r10", "r8", "r9"}
+
+// returnRegisters carry the declared results of a procedure back to the
+// caller, the first result is the deepest value on the stack.
+var returnRegisters = []string{"rax", "rdx", "rcx", "rsi", "rdi", "r8"}
+
+// Options are the code generation settings picked on the command line.
+type Options struct {
+	BoundsCheck bool
+}
+
+type Generator struct {
+	Options
+	text    string
+	data    string
+	rodata  string
+	bss     string
+	proc    *ast.Proc
+	main    *ast.Proc
+	loops   map[ast.Node]string
+	labels  map[string]int
+	strings map[string]string
+}
+
+// Label names a construct after the procedure and the source line it comes
+// from, e.g. `main.while.3`. Constructs sharing a line, like the ones inside
+// a macro used several times, get a counter appended so builds always produce
+// the same assembly.
+func (g *Generator) Label(kind string, pos ast.Pos) string {
+	owner := "global"
+	if g.proc != nil {
+		owner = g.proc.Name
+	}
+	label := fmt.Sprintf("%s.%s.%d", owner, kind, pos.Row)
+	g.labels[label]++
+	if n := g.labels[label]; n > 1 {
+		label = fmt.Sprintf("%s.%d", label, n)
+	}
+	return label
+}
+
+// Generate turns a parsed program, including everything it imports, into
+// GNU assembler source with `_start` calling the `main` procedure.
+func Generate(prog *ast.Program, options Options) string {
+	g := &Generator{Options: options, loops: make(map[ast.Node]string), labels: make(map[string]int), strings: make(map[string]string)}
+	g.Program(prog)
+
+	start := "\tcall main\n\tpush %rax\n\tmovq $60, %rax\n\tpop %rdi\n\tsyscall\n"
+	if g.main != nil && g.main.Declared && len(g.main.Returns) == 0 {
+		start = "\tcall main\n\tmovq $60, %rax\n\txor %rdi, %rdi\n\tsyscall\n"
+	}
+	return fmt.Sprintf(".section .data\n%s\n.section .rodata\n%s\n.section .bss\n%s\n.section .text\n\t.global _start\n%s\n%s\n_start:\n%s", g.data, g.rodata, g.bss, printNumText, g.text, start)
+}
+
+func (g *Generator) Program(prog *ast.Program) {
+	g.Block(prog.Body)
+}
+
+func (g *Generator) Block(nodes []ast.Node) {
+	for _, node := range nodes {
+		g.Node(node)
+	}
+}
+
+func (g *Generator) Node(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.Import:
+		g.text += fmt.Sprintf("\t## IMPORT %s ##\n", node.Path)
+		if node.Program != nil {
+			g.Program(node.Program)
+		}
+		g.text += fmt.Sprintf("\t## FILE %s ##\n", node.File)
+	case *ast.Proc:
+		g.Proc(node)
+	case *ast.Buffer:
+		g.bss += fmt.Sprintf("%s:\n", node.Name)
+		g.bss += fmt.Sprintf("\t.space %d\n", node.Size)
+	case *ast.Var:
+		if node.HasInit && node.Type.Size() == 1 {
+			g.data += fmt.Sprintf("\t%s: .byte %d\n", node.Name, node.Init)
+		} else if node.HasInit {
+			g.data += fmt.Sprintf("\t%s: .quad %d\n", node.Name, node.Init)
+		} else {
+			g.bss += fmt.Sprintf("%s:\n", node.Name)
+			g.bss += fmt.Sprintf("\t.space %d\n", node.Type.Size())
+		}
+	case *ast.If:
+		g.If(node)
+	case *ast.While:
+		g.While(node)
+	case *ast.Literal:
+		g.Literal(node)
+	case *ast.Operator:
+		g.Operator(node)
+	case *ast.Keyword:
+		g.Keyword(node)
+	case *ast.Return:
+		g.text += "\t## RETURN ##\n"
+		g.Leave()
+	case *ast.Syscall:
+		g.text += "\t## SYSCALL ##\n"
+		for i := node.Argc - 1; i >= 0; i-- {
+			g.text += fmt.Sprintf("\tpop %%%s\n", registers[i])
+		}
+		g.text += "\tsyscall\n"
+		g.text += "\tpush %rax\n"
+	case *ast.Call:
+		g.text += fmt.Sprintf("\t## CALL %s ##\n", node.Name)
+		g.text += fmt.Sprintf("\tcall %s\n", node.Name)
+		if len(node.Proc.Args) > 0 {
+			g.text += fmt.Sprintf("\taddq $%d, %%rsp\n", len(node.Proc.Args)*8)
+		}
+		if !node.Proc.Declared {
+			g.text += "\tpush %rax\n"
+		}
+		for i := range node.Proc.Returns {
+			g.text += fmt.Sprintf("\tpush %%%s\n", returnRegisters[i])
+		}
+	case *ast.BufferRef:
+		g.text += "\t## GET BUFFER ##\n"
+		g.text += fmt.Sprintf("\tmovq $%s, %%rax\n", node.Name)
+		g.text += "\tpush %rax\n"
+	case *ast.VarRef:
+		g.text += fmt.Sprintf("\t## GET VAR %s ##\n", node.Var.Name)
+		g.text += fmt.Sprintf("\tmovq $%s, %%rax\n", node.Var.Name)
+		g.text += "\tpush %rax\n"
+	case *ast.VarLoad:
+		g.text += fmt.Sprintf("\t## LOAD %s ##\n", node.Var.Name)
+		if node.Var.Type.Size() == 1 {
+			g.text += fmt.Sprintf("\tmovzbq %s, %%rax\n", node.Var.Name)
+		} else {
+			g.text += fmt.Sprintf("\tmovq %s, %%rax\n", node.Var.Name)
+		}
+		g.text += "\tpush %rax\n"
+	case *ast.VarStore:
+		g.text += fmt.Sprintf("\t## STORE %s ##\n", node.Var.Name)
+		g.text += "\tpop %rax\n"
+		if node.Var.Type.Size() == 1 {
+			g.text += fmt.Sprintf("\tmovb %%al, %s\n", node.Var.Name)
+		} else {
+			g.text += fmt.Sprintf("\tmovq %%rax, %s\n", node.Var.Name)
+		}
+	case *ast.For:
+		g.For(node)
+	case *ast.Match:
+		g.Match(node)
+	case *ast.Break:
+		g.text += "\t## BREAK ##\n"
+		g.text += fmt.Sprintf("\tjmp %s.end\n", g.loops[node.Loop])
+	case *ast.Continue:
+		g.text += "\t## CONTINUE ##\n"
+		if _, ok := node.Loop.(*ast.For); ok {
+			g.text += fmt.Sprintf("\tjmp %s.next\n", g.loops[node.Loop])
+		} else {
+			g.text += fmt.Sprintf("\tjmp %s.cond\n", g.loops[node.Loop])
+		}
+	case *ast.Asm:
+		g.text += "\t## ASM ##\n"
+		for i := len(node.Args) - 1; i >= 0; i-- {
+			g.text += fmt.Sprintf("\tpop %%%s\n", returnRegisters[i])
+		}
+		for _, line := range node.Code {
+			g.text += fmt.Sprintf("\t%s\n", line)
+		}
+		for i := range node.Returns {
+			g.text += fmt.Sprintf("\tpush %%%s\n", returnRegisters[i])
+		}
+	case *ast.Expansion:
+		g.text += fmt.Sprintf("\t## MACRO %s ##\n", node.Macro.Name)
+		g.Block(node.Body)
+	case *ast.Index:
+		if node.Array == nil {
+			// Only unreachable code is left unbound by the checker.
+			break
+		}
+		g.text += fmt.Sprintf("\t## INDEX %s ##\n", node.Array.Name)
+		g.text += "\tpop %rbx\n"
+		g.text += "\tpop %rax\n"
+		g.boundsCheck(node.Pos, node.Array)
+		if node.Array.Type.Size() == 1 {
+			g.text += "\tmovzbq (%rax,%rbx,1), %rax\n"
+		} else {
+			g.text += "\tmovq (%rax,%rbx,8), %rax\n"
+		}
+		g.text += "\tpush %rax\n"
+	case *ast.IndexStore:
+		if node.Array == nil {
+			break
+		}
+		g.text += fmt.Sprintf("\t## INDEX STORE %s ##\n", node.Array.Name)
+		g.text += "\tpop %rcx\n"
+		g.text += "\tpop %rbx\n"
+		g.text += "\tpop %rax\n"
+		g.boundsCheck(node.Pos, node.Array)
+		if node.Array.Type.Size() == 1 {
+			g.text += "\tmovb %cl, (%rax,%rbx,1)\n"
+		} else {
+			g.text += "\tmovq %rcx, (%rax,%rbx,8)\n"
+		}
+	case *ast.FieldLoad:
+		g.text += fmt.Sprintf("\t## LOAD %s ##\n", node.Name)
+		g.text += "\tpop %rax\n"
+		switch node.Field.Width {
+		case 1:
+			g.text += fmt.Sprintf("\tmovzbq %d(%%rax), %%rax\n", node.Offset)
+		case 2:
+			g.text += fmt.Sprintf("\tmovzwq %d(%%rax), %%rax\n", node.Offset)
+		case 4:
+			g.text += fmt.Sprintf("\tmovl %d(%%rax), %%eax\n", node.Offset)
+		default:
+			g.text += fmt.Sprintf("\tmovq %d(%%rax), %%rax\n", node.Offset)
+		}
+		g.text += "\tpush %rax\n"
+	case *ast.FieldStore:
+		g.text += fmt.Sprintf("\t## STORE %s ##\n", node.Name)
+		g.text += "\tpop %rbx\n"
+		g.text += "\tpop %rax\n"
+		switch node.Field.Width {
+		case 1:
+			g.text += fmt.Sprintf("\tmovb %%bl, %d(%%rax)\n", node.Offset)
+		case 2:
+			g.text += fmt.Sprintf("\tmovw %%bx, %d(%%rax)\n", node.Offset)
+		case 4:
+			g.text += fmt.Sprintf("\tmovl %%ebx, %d(%%rax)\n", node.Offset)
+		default:
+			g.text += fmt.Sprintf("\tmovq %%rbx, %d(%%rax)\n", node.Offset)
+		}
+	case *ast.ArgRef:
+		g.text += fmt.Sprintf("\t## GET ARG %s ##\n", node.Name)
+		g.text += fmt.Sprintf("\tmovq %d(%%rbp), %%rax\n", g.argOffset(node.Index))
+		g.text += "\tpush %rax\n"
+	case *ast.ArgStore:
+		g.text += fmt.Sprintf("\t## SET ARG %s ##\n", node.Name)
+		g.text += "\tpop %rax\n"
+		g.text += fmt.Sprintf("\tmovq %%rax, %d(%%rbp)\n", g.argOffset(node.Index))
+	case *ast.Let:
+		g.text += "\t## LET ##\n"
+		for i := len(node.Locals) - 1; i >= 0; i-- {
+			g.text += "\tpop %rax\n"
+			g.text += fmt.Sprintf("\tmovq %%rax, %d(%%rbp)\n", localOffset(node.Locals[i]))
+		}
+		g.Block(node.Body)
+	case *ast.LocalRef:
+		g.text += fmt.Sprintf("\t## GET LOCAL %s ##\n", node.Local.Name)
+		g.text += fmt.Sprintf("\tmovq %d(%%rbp), %%rax\n", localOffset(node.Local))
+		g.text += "\tpush %rax\n"
+	case *ast.LocalStore:
+		g.text += fmt.Sprintf("\t## SET LOCAL %s ##\n", node.Local.Name)
+		g.text += "\tpop %rax\n"
+		g.text += fmt.Sprintf("\tmovq %%rax, %d(%%rbp)\n", localOffset(node.Local))
+	}
+}
+
+// argOffset is the position of an argument relative to the base pointer,
+// the last argument was pushed last and sits right above the return address.
+func (g *Generator) argOffset(index int) int {
+	return ((len(g.proc.Args)-1)-index)*8 + 16
+}
+
+func localOffset(local *ast.Local) int {
+	return -(local.Slot + 1) * 8
+}
+
+func (g *Generator) Proc(proc *ast.Proc) {
+	g.text += "## PROC ##\n"
+	g.text += fmt.Sprintf("%s:\n", proc.Name)
+	g.text += "\tpush %rbp\n"
+	g.text += "\tmovq %rsp, %rbp\n"
+	if proc.Frame > 0 {
+		g.text += fmt.Sprintf("\tsubq $%d, %%rsp\n", proc.Frame*8)
+	}
+	g.proc = proc
+	if proc.Name == "main" {
+		g.main = proc
+	}
+	g.Block(proc.Body)
+	g.text += "\t## END ##\n"
+	g.Leave()
+	g.proc = nil
+}
+
+// Leave moves the results of the current procedure into their registers and
+// returns to the caller.
+func (g *Generator) Leave() {
+	if !g.proc.Declared {
+		g.text += "\tpop %rax\n"
+	}
+	for i := len(g.proc.Returns) - 1; i >= 0; i-- {
+		g.text += fmt.Sprintf("\tpop %%%s\n", returnRegisters[i])
+	}
+	g.text += "\tmov %rbp, %rsp\n"
+	g.text += "\tpop %rbp\n"
+	g.text += "\tret\n"
+}
+
+func (g *Generator) If(node *ast.If) {
+	label := g.Label("if", node.Pos)
+	g.text += "\t## IF ##\n"
+	g.text += "\tpop %rax\n"
+	g.text += "\ttest %rax, %rax\n"
+	g.text += fmt.Sprintf("\tje %s.else\n", label)
+	g.Block(node.Then)
+	if node.HasElse {
+		g.text += "\t## ELSE ##\n"
+		g.text += fmt.Sprintf("\tjmp %s.end\n", label)
+		g.text += fmt.Sprintf("%s.else:\n", label)
+		g.Block(node.Else)
+	}
+	g.text += "\t## END ##\n"
+	if !node.HasElse {
+		g.text += fmt.Sprintf("%s.else:\n", label)
+	}
+	g.text += fmt.Sprintf("%s.end:\n", label)
+}
+
+func (g *Generator) While(node *ast.While) {
+	label := g.Label("while", node.Pos)
+	g.loops[node] = label
+	g.text += "\t## WHILE ##\n"
+	g.text += fmt.Sprintf("%s.cond:\n", label)
+	g.Block(node.Cond)
+	g.text += "\t## DO ##\n"
+	g.text += "\tpop %rax\n"
+	g.text += "\ttest %rax, %rax\n"
+	g.text += fmt.Sprintf("\tje %s.end\n", label)
+	g.Block(node.Body)
+	g.text += "\t## END ##\n"
+	g.text += fmt.Sprintf("\tjmp %s.cond\n", label)
+	g.text += fmt.Sprintf("%s.end:\n", label)
+}
+
+func (g *Generator) For(node *ast.For) {
+	label := g.Label("for", node.Pos)
+	g.loops[node] = label
+	i, end := localOffset(node.Var), localOffset(node.End)
+	exit := "jge"
+	if node.Step < 0 {
+		exit = "jle"
+	}
+
+	g.text += fmt.Sprintf("\t## FOR %s ##\n", node.Var.Name)
+	g.Block(node.Bounds)
+	g.text += "\tpop %rax\n"
+	g.text += fmt.Sprintf("\tmovq %%rax, %d(%%rbp)\n", end)
+	g.text += "\tpop %rax\n"
+	g.text += fmt.Sprintf("\tmovq %%rax, %d(%%rbp)\n", i)
+	g.text += fmt.Sprintf("%s.cond:\n", label)
+	g.text += fmt.Sprintf("\tmovq %d(%%rbp), %%rax\n", i)
+	g.text += fmt.Sprintf("\tcmpq %d(%%rbp), %%rax\n", end)
+	g.text += fmt.Sprintf("\t%s %s.end\n", exit, label)
+	g.Block(node.Body)
+	g.text += "\t## END ##\n"
+	g.text += fmt.Sprintf("%s.next:\n", label)
+	g.text += fmt.Sprintf("\taddq $%d, %d(%%rbp)\n", node.Step, i)
+	g.text += fmt.Sprintf("\tjo %s.end\n", label)
+	g.text += fmt.Sprintf("\tjmp %s.cond\n", label)
+	g.text += fmt.Sprintf("%s.end:\n", label)
+}
+
+// Match jumps through a table in `.rodata` when the case values are dense
+// enough and compares against every value in turn otherwise.
+func (g *Generator) Match(node *ast.Match) {
+	label := g.Label("match", node.Pos)
+	g.text += "\t## MATCH ##\n"
+	g.text += "\tpop %rax\n"
+
+	if low, high, ok := jumpTable(node.Cases); ok {
+		targets := make([]string, high-low+1)
+		for i := range targets {
+			targets[i] = label + ".default"
+		}
+		for i, c := range node.Cases {
+			targets[c.Value-low] = fmt.Sprintf("%s.case.%d", label, i)
+		}
+		g.rodata += fmt.Sprintf("%s.table:\n\t.quad %s\n", label, strings.Join(targets, ", "))
+		if low != 0 {
+			g.text += fmt.Sprintf("\tsubq $%d, %%rax\n", low)
+		}
+		g.text += fmt.Sprintf("\tcmpq $%d, %%rax\n", high-low)
+		g.text += fmt.Sprintf("\tja %s.default\n", label)
+		g.text += fmt.Sprintf("\tjmp *%s.table(,%%rax,8)\n", label)
+	} else {
+		for i, c := range node.Cases {
+			if c.Value == int64(int32(c.Value)) {
+				g.text += fmt.Sprintf("\tcmpq $%d, %%rax\n", c.Value)
+			} else {
+				g.text += fmt.Sprintf("\tmovabsq $%d, %%rbx\n", c.Value)
+				g.text += "\tcmpq %rbx, %rax\n"
+			}
+			g.text += fmt.Sprintf("\tje %s.case.%d\n", label, i)
+		}
+		g.text += fmt.Sprintf("\tjmp %s.default\n", label)
+	}
+
+	for i, c := range node.Cases {
+		g.text += fmt.Sprintf("\t## CASE %d ##\n", c.Value)
+		g.text += fmt.Sprintf("%s.case.%d:\n", label, i)
+		g.Block(c.Body)
+		g.text += fmt.Sprintf("\tjmp %s.end\n", label)
+	}
+	g.text += "\t## DEFAULT ##\n"
+	g.text += fmt.Sprintf("%s.default:\n", label)
+	g.Block(node.Default)
+	g.text += "\t## END ##\n"
+	g.text += fmt.Sprintf("%s.end:\n", label)
+}
+
+// jumpTable decides whether a match gets a jump table, it needs at least four
+// cases filling at least half of the range between the lowest and highest
+// value.
+func jumpTable(cases []*ast.Case) (int64, int64, bool) {
+	if len(cases) < 4 {
+		return 0, 0, false
+	}
+	low, high := cases[0].Value, cases[0].Value
+	for _, c := range cases {
+		low, high = min(low, c.Value), max(high, c.Value)
+	}
+	if low != int64(int32(low)) || high != int64(int32(high)) {
+		return 0, 0, false
+	}
+	return low, high, high-low+1 <= int64(len(cases))*2
+}
+
+func (g *Generator) Literal(node *ast.Literal) {
+	switch node.Kind {
+	case ast.INT_LIT:
+		g.text += "\t## PUSH ##\n"
+		g.text += fmt.Sprintf("\tmovq $%s, %%rax\n", node.Value)
+		g.text += "\tpush %rax\n"
+	case ast.CHAR_LIT:
+		g.text += "\t## CHAR ##\n"
+		g.text += fmt.Sprintf("\tmovq $%s, %%rax\n", node.Value)
+		g.text += "\tpush %rax\n"
+	case ast.BOOL_LIT:
+		if node.Value == "true" {
+			g.text += "\t## TRUE ##\n"
+			g.text += "\tmovq $1, %rax\n"
+		} else {
+			g.text += "\t## FALSE ##\n"
+			g.text += "\tmovq $0, %rax\n"
+		}
+		g.text += "\tpush %rax\n"
+	case ast.STRING_LIT:
+		g.text += "\t## STRING ##\n"
+		g.text += fmt.Sprintf("\tmovq $%s, %%rax\n", g.String(node.Value))
+		g.text += "\tpush %rax\n"
+	}
+}
+
+// boundsCheck compares the index in %rbx against the length of the array
+// when `--bounds-check` is enabled, an index outside of it prints the source
+// position to stderr and exits with 1. Negative indexes fail the unsigned
+// comparison as well.
+func (g *Generator) boundsCheck(pos ast.Pos, array *ast.Buffer) {
+	if !g.BoundsCheck {
+		return
+	}
+	label := g.Label("bounds", pos)
+	message := fmt.Sprintf("%d:%d %s Error: Index out of bounds for `%s`\n", pos.Row, pos.Col, pos.File, array.Name)
+	g.text += fmt.Sprintf("\tcmpq $%d, %%rbx\n", array.Count)
+	g.text += fmt.Sprintf("\tjb %s.ok\n", label)
+	g.text += "\tmovq $1, %rax\n"
+	g.text += "\tmovq $2, %rdi\n"
+	g.text += fmt.Sprintf("\tmovq $%s, %%rsi\n", g.String(message))
+	g.text += fmt.Sprintf("\tmovq $%d, %%rdx\n", len(message))
+	g.text += "\tsyscall\n"
+	g.text += "\tmovq $60, %rax\n"
+	g.text += "\tmovq $1, %rdi\n"
+	g.text += "\tsyscall\n"
+	g.text += fmt.Sprintf("%s.ok:\n", label)
+}
+
+// String returns the label of a string literal in `.rodata`, equal literals
+// share one label.
+func (g *Generator) String(value string) string {
+	if label, ok := g.strings[value]; ok {
+		return label
+	}
+	label := fmt.Sprintf("str.%d", len(g.strings))
+	g.strings[value] = label
+	g.rodata += fmt.Sprintf("\t%s: .byte %s\n", label, bytesList(value))
+	return label
+}
+
+// bytesList renders a string as a null-terminated `.byte` operand list so
+// its content never has to be escaped for the assembler.
+func bytesList(value string) string {
+	bytes := make([]string, 0, len(value)+1)
+	for i := 0; i < len(value); i++ {
+		bytes = append(bytes, strconv.Itoa(int(value[i])))
+	}
+	bytes = append(bytes, "0")
+	return strings.Join(bytes, ",")
+}
+
+func (g *Generator) Operator(node *ast.Operator) {
+	switch node.Op {
+	case "+":
+		g.text += "\t## ADD ##\n"
+		g.text += "\tpop %rbx\n\tpop %rax\n"
+		g.text += "\taddq %rbx, %rax\n"
+		g.text += "\tpush %rax\n"
+	case "-":
+		g.text += "\t## SUB ##\n"
+		g.text += "\tpop %rbx\n\tpop %rax\n"
+		g.text += "\tsubq %rbx, %rax\n"
+		g.text += "\tpush %rax\n"
+	case "*":
+		g.text += "\t## MUL ##\n"
+		g.text += "\tpop %rbx\n\tpop %rax\n"
+		g.text += "\timulq %rbx\n"
+		g.text += "\tpush %rax\n"
+	case "/":
+		g.text += "\t## DIV ##\n"
+		g.divide()
+		g.text += "\tpush %rax\n"
+	case "%":
+		g.text += "\t## MOD ##\n"
+		g.divide()
+		g.text += "\tpush %rdx\n"
+	case "&":
+		g.bitwise("AND", "andq")
+	case "|":
+		g.bitwise("OR", "orq")
+	case "^":
+		g.bitwise("XOR", "xorq")
+	case "~":
+		g.text += "\t## BITWISE NOT ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tnotq %rax\n"
+		g.text += "\tpush %rax\n"
+	case "<<":
+		g.shift("SHIFT LEFT", "shlq")
+	case ">>":
+		g.shift("SHIFT RIGHT", "sarq")
+	case ">>>":
+		g.shift("LOGICAL SHIFT RIGHT", "shrq")
+	case "=":
+		g.compare("EQUAL", "sete")
+	case "!", "!=":
+		g.compare("NOT EQUAL", "setne")
+	case "<":
+		g.compare("LESS THAN", "setl")
+	case ">":
+		g.compare("GREATER THAN", "setg")
+	case "<=":
+		g.compare("LESS OR EQUAL", "setle")
+	case ">=":
+		g.compare("GREATER OR EQUAL", "setge")
+	}
+}
+
+// divide leaves the signed quotient of the top two values in %rax and the
+// remainder in %rdx.
+func (g *Generator) divide() {
+	g.text += "\tpop %rbx\n\tpop %rax\n"
+	g.text += "\tcqto\n"
+	g.text += "\tidivq %rbx\n"
+}
+
+func (g *Generator) bitwise(name, instr string) {
+	g.text += fmt.Sprintf("\t## %s ##\n", name)
+	g.text += "\tpop %rbx\n\tpop %rax\n"
+	g.text += fmt.Sprintf("\t%s %%rbx, %%rax\n", instr)
+	g.text += "\tpush %rax\n"
+}
+
+// shift shifts the second value on the stack by the amount on top of it.
+func (g *Generator) shift(name, instr string) {
+	g.text += fmt.Sprintf("\t## %s ##\n", name)
+	g.text += "\tpop %rcx\n\tpop %rax\n"
+	g.text += fmt.Sprintf("\t%s %%cl, %%rax\n", instr)
+	g.text += "\tpush %rax\n"
+}
+
+// store writes the top value on the stack to the address below it.
+func (g *Generator) store(name, mov string) {
+	g.text += fmt.Sprintf("\t## %s ##\n", name)
+	g.text += "\tpop %rbx\n"
+	g.text += "\tpop %rax\n"
+	g.text += fmt.Sprintf("\t%s, (%%rax)\n", mov)
+}
+
+func (g *Generator) compare(name, set string) {
+	g.text += fmt.Sprintf("\t## %s ##\n", name)
+	g.text += "\tpop %rax\n"
+	g.text += "\tpop %rbx\n"
+	g.text += "\tcmpq %rax, %rbx\n"
+	g.text += fmt.Sprintf("\t%s %%cl\n", set)
+	g.text += "\tmovzbq %cl, %rcx\n"
+	g.text += "\tpush %rcx\n"
+}
+
+func (g *Generator) Keyword(node *ast.Keyword) {
+	switch node.Name {
+	case "dup":
+		g.text += "\t## DUP ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tpush %rax\n"
+		g.text += "\tpush %rax\n"
+	case "drop":
+		g.text += "\t## DROP ##\n"
+		g.text += "\tpop %rax\n"
+	case "swap":
+		g.text += "\t## SWAP ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tpop %rbx\n"
+		g.text += "\tpush %rax\n"
+		g.text += "\tpush %rbx\n"
+	case "inc":
+		g.text += "\t## INC ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tinc %rax\n"
+		g.text += "\tpush %rax\n"
+	case "dec":
+		g.text += "\t## DEC ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tdec %rax\n"
+		g.text += "\tpush %rax\n"
+	case "and":
+		g.bitwise("AND", "andq")
+	case "or":
+		g.bitwise("OR", "orq")
+	case "not":
+		g.text += "\t## NOT ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\txorq $1, %rax\n"
+		g.text += "\tpush %rax\n"
+	case "neg":
+		g.text += "\t## NEG ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tnegq %rax\n"
+		g.text += "\tpush %rax\n"
+	case "divmod":
+		g.text += "\t## DIVMOD ##\n"
+		g.divide()
+		g.text += "\tpush %rax\n"
+		g.text += "\tpush %rdx\n"
+	case "dump":
+		g.text += "\t## DUMP ##\n"
+		g.text += "\tpop %rdi\n"
+		g.text += "\tcall dump\n"
+	case "derefc":
+		g.text += "\t## DEREFC ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\txor %rbx, %rbx\n"
+		g.text += "\tmov (%rax), %bl\n"
+		g.text += "\tpush %rbx\n"
+	case "derefw":
+		g.text += "\t## DEREFW ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tmovzwq (%rax), %rbx\n"
+		g.text += "\tpush %rbx\n"
+	case "derefd":
+		g.text += "\t## DEREFD ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tmovl (%rax), %ebx\n"
+		g.text += "\tpush %rbx\n"
+	case "derefi":
+		g.text += "\t## DEREFI ##\n"
+		g.text += "\tpop %rax\n"
+		g.text += "\tmov (%rax), %rbx\n"
+		g.text += "\tpush %rbx\n"
+	case "storec":
+		g.store("STOREC", "movb %bl")
+	case "storew":
+		g.store("STOREW", "movw %bx")
+	case "stored":
+		g.store("STORED", "movl %ebx")
+	case "storei":
+		g.store("STOREI", "movq %rbx")
+	}
+}
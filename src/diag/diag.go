@@ -0,0 +1,112 @@
+package diag
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Severity uint
+type Diagnostics []Diagnostic
+
+const (
+	ERROR Severity = iota
+	WARNING
+	NOTE
+)
+
+// Note points at a secondary location related to a diagnostic, such as the
+// previous definition of a duplicated name. Repeat counts how many times the
+// same note was attached in a row.
+type Note struct {
+	File    string
+	Row     int
+	Col     int
+	Message string
+	Repeat  int
+}
+
+type Diagnostic struct {
+	File     string
+	Row      int
+	Col      int
+	Severity Severity
+	Message  string
+	Notes    []Note
+}
+
+func (s Severity) String() string {
+	switch s {
+	case WARNING:
+		return "Warning"
+	case NOTE:
+		return "Note"
+	}
+	return "Error"
+}
+
+func format(file string, row, col int, severity Severity, message string) string {
+	if row == 0 {
+		if file == "" {
+			return fmt.Sprintf("%s: %s", severity, message)
+		}
+		return fmt.Sprintf("%s %s: %s", file, severity, message)
+	}
+	return fmt.Sprintf("%d:%d %s %s: %s", row, col, file, severity, message)
+}
+
+func (d Diagnostic) Error() string {
+	lines := []string{format(d.File, d.Row, d.Col, d.Severity, d.Message)}
+	for _, note := range d.Notes {
+		message := note.Message
+		if note.Repeat > 1 {
+			message = fmt.Sprintf("%s (%d times)", message, note.Repeat)
+		}
+		lines = append(lines, "  "+format(note.File, note.Row, note.Col, NOTE, message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WithNote attaches a secondary location to the diagnostic, a note equal to
+// the previous one only increases its repeat count.
+func (d Diagnostic) WithNote(file string, row, col int, format string, a ...any) Diagnostic {
+	note := Note{file, row, col, fmt.Sprintf(format, a...), 1}
+	if last := len(d.Notes) - 1; last >= 0 {
+		if prev := d.Notes[last]; prev.File == file && prev.Row == row && prev.Col == col && prev.Message == note.Message {
+			d.Notes = append(d.Notes[:last:last], Note{file, row, col, note.Message, prev.Repeat + 1})
+			return d
+		}
+	}
+	d.Notes = append(d.Notes, note)
+	return d
+}
+
+func New(severity Severity, file string, row, col int, format string, a ...any) Diagnostic {
+	return Diagnostic{
+		File:     file,
+		Row:      row,
+		Col:      col,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, a...),
+	}
+}
+
+func (d *Diagnostics) Add(diagnostic Diagnostic) {
+	*d = append(*d, diagnostic)
+}
+
+func (d *Diagnostics) Error(file string, row, col int, format string, a ...any) {
+	d.Add(New(ERROR, file, row, col, format, a...))
+}
+
+func (d *Diagnostics) Warning(file string, row, col int, format string, a ...any) {
+	d.Add(New(WARNING, file, row, col, format, a...))
+}
+
+func (d Diagnostics) HasErrors() bool {
+	for _, diagnostic := range d {
+		if diagnostic.Severity == ERROR {
+			return true
+		}
+	}
+	return false
+}
@@ -1,23 +1,27 @@
 package lexer
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"os"
+	"strconv"
+	"strings"
+	"xyl/src/diag"
 )
 
 type TokenType uint
 type Tokens []Token
 
 type Lexer struct {
-	Filename string
-	Contents []byte
-	Tokens   Tokens
-	Position int
-	Row      int
-	Col      int
-	Errors   []error
-	IsLib    bool
-	Clean    bool
+	Filename    string
+	Contents    []byte
+	Tokens      Tokens
+	Position    int
+	Row         int
+	Col         int
+	Diagnostics diag.Diagnostics
+	IsLib       bool
+	Clean       bool
 }
 
 type Token struct {
@@ -43,6 +47,11 @@ const (
 	PROC
 	BOOL
 	INT
+	RETURN_TYPE
+	CHAR
+	FIELD
+	SIZEOF
+	DIRECTIVE
 )
 
 func NewLexer(filename string, isLib, clean bool) (*Lexer, error) {
@@ -52,15 +61,15 @@ func NewLexer(filename string, isLib, clean bool) (*Lexer, error) {
 	}
 
 	lexer := &Lexer{
-		Filename: filename,
-		Contents: contents,
-		Tokens:   Tokens{},
-		Position: 0,
-		Row:      1,
-		Col:      1,
-		Errors:   []error{},
-		IsLib:    isLib,
-		Clean:    clean,
+		Filename:    filename,
+		Contents:    contents,
+		Tokens:      Tokens{},
+		Position:    0,
+		Row:         1,
+		Col:         1,
+		Diagnostics: diag.Diagnostics{},
+		IsLib:       isLib,
+		Clean:       clean,
 	}
 	return lexer, nil
 }
@@ -85,6 +94,13 @@ func (l *Lexer) Peek() byte {
 	return 0
 }
 
+func (l *Lexer) PeekNext() byte {
+	if l.Position+1 < len(l.Contents) {
+		return l.Contents[l.Position+1]
+	}
+	return 0
+}
+
 func (l *Lexer) Move() {
 	if l.Peek() == '\n' {
 		l.Col = 0
@@ -122,7 +138,7 @@ func (l *Lexer) LexArg() (TokenType, string) {
 		kind = VOID_ARG
 		return kind, ""
 	default:
-		l.NewError("%d:%d %s Error: Invalid type : `%s`", row, col, l.Filename, buf)
+		l.NewError(row, col, "Invalid type : `%s`", buf)
 		return VOID_ARG, ""
 	}
 
@@ -133,7 +149,7 @@ func (l *Lexer) LexArg() (TokenType, string) {
 	ch = l.Peek()
 	row, col = l.Row, l.Col
 	if !l.IsAlpha() {
-		l.NewError("%d:%d %s Error: Invalid char : `%c`", row, col, l.Filename, ch)
+		l.NewError(row, col, "Invalid char : `%c`", ch)
 		return VOID_ARG, ""
 	}
 
@@ -146,24 +162,227 @@ func (l *Lexer) LexArg() (TokenType, string) {
 	return kind, buf
 }
 
+// LexReturns lexes the types following `->` in a procedure signature up to
+// and including the closing `in`.
+func (l *Lexer) LexReturns() {
+	for {
+		for l.IsSpace() {
+			l.Move()
+		}
+
+		var buf string
+		row, col := l.Row, l.Col
+		for l.IsAlpha() {
+			buf += string(l.Peek())
+			l.Move()
+		}
+		switch buf {
+		case "ptr", "int", "bool", "char", "void":
+			l.Tokens.AppendToken(RETURN_TYPE, buf, row, col)
+		case "in":
+			l.Tokens.AppendToken(VOID_ARG, "", row, col)
+			return
+		default:
+			l.NewError(row, col, "Invalid return type : `%s`", buf)
+			l.Tokens.AppendToken(VOID_ARG, "", row, col)
+			return
+		}
+	}
+}
+
+func hexValue(ch byte) (byte, bool) {
+	switch {
+	case '0' <= ch && ch <= '9':
+		return ch - '0', true
+	case 'a' <= ch && ch <= 'f':
+		return ch - 'a' + 10, true
+	case 'A' <= ch && ch <= 'F':
+		return ch - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// LexEscape decodes the escape sequence starting at the current `\` and
+// returns the byte it stands for.
+func (l *Lexer) LexEscape() byte {
+	row, col := l.Row, l.Col
+	l.Move()
+	ch := l.Peek()
+	if ch == '\n' || l.AtEnd() {
+		l.NewError(row, col, "Unfinished escape sequence")
+		return '\\'
+	}
+	l.Move()
+
+	switch ch {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case '0':
+		return 0
+	case '\\', '"', '\'':
+		return ch
+	case 'x':
+		hi, ok := hexValue(l.Peek())
+		if ok {
+			l.Move()
+			var lo byte
+			lo, ok = hexValue(l.Peek())
+			if ok {
+				l.Move()
+				return hi<<4 | lo
+			}
+		}
+		l.NewError(row, col, "Expected two hex digits after `\\x`")
+		return 0
+	}
+	l.NewError(row, col, "Unknown escape sequence : `\\%c`", ch)
+	return ch
+}
+
+// LexChar lexes a character literal, the token holds the decimal value of
+// the byte.
+func (l *Lexer) LexChar() {
+	row, col := l.Row, l.Col
+	l.Move()
+
+	var value byte
+	switch l.Peek() {
+	case '\'', '\n', 0:
+		l.NewError(row, col, "Empty character literal")
+	case '\\':
+		value = l.LexEscape()
+	default:
+		value = l.Peek()
+		l.Move()
+	}
+
+	if l.Peek() != '\'' {
+		l.NewError(row, col, "Unclosed character literal")
+		for !l.AtEnd() && l.Peek() != '\'' && l.Peek() != '\n' {
+			l.Move()
+		}
+	}
+	if l.Peek() == '\'' {
+		l.Move()
+	}
+	l.Tokens.AppendToken(CHAR, strconv.Itoa(int(value)), row, col)
+}
+
+// LexInt lexes a decimal, `0x` hex, `0b` binary or `0o` octal integer whose
+// digits may be separated by `_`, and returns its canonical decimal value.
+// Literals up to 64 bits are accepted, values above the signed range wrap
+// around like they do in the generated code. A leading `-` makes the literal
+// negative, down to the smallest signed 64 bit value.
 func (l *Lexer) LexInt() string {
+	row, col := l.Row, l.Col
+	negative := l.Peek() == '-'
+	if negative {
+		l.Move()
+	}
+
 	var buf string
-	ch := l.Peek()
-	for l.IsInt() {
+	for l.IsInt() || l.IsAlpha() {
+		buf += string(l.Peek())
 		l.Move()
-		buf += string(ch)
-		ch = l.Peek()
 	}
-	return buf
+	literal := buf
+	if negative {
+		literal = "-" + buf
+	}
+
+	base := 10
+	digits := buf
+	if len(buf) > 1 && buf[0] == '0' {
+		switch buf[1] {
+		case 'x', 'X':
+			base, digits = 16, buf[2:]
+		case 'b', 'B':
+			base, digits = 2, buf[2:]
+		case 'o', 'O':
+			base, digits = 8, buf[2:]
+		}
+	}
+
+	if digits == "" || digits[0] == '_' || digits[len(digits)-1] == '_' || strings.Contains(digits, "__") {
+		l.NewError(row, col, "Invalid integer literal : `%s`", literal)
+		return "0"
+	}
+	value, err := strconv.ParseUint(strings.ReplaceAll(digits, "_", ""), base, 64)
+	if negative && err == nil {
+		if value > 1<<63 {
+			err = strconv.ErrRange
+		}
+		value = -value
+	}
+	if errors.Is(err, strconv.ErrRange) {
+		l.NewError(row, col, "Integer literal does not fit in 64 bits : `%s`", literal)
+		return "0"
+	} else if err != nil {
+		l.NewError(row, col, "Invalid integer literal : `%s`", literal)
+		return "0"
+	}
+	return strconv.FormatInt(int64(value), 10)
+}
+
+// LexDirective lexes `#if target`, `#else` and `#end` on a line of their own,
+// only a comment may follow them and the condition of `#if` is a single word.
+// Any other `#` starts a comment, like `#end of setup` or `#if not sure`.
+func (l *Lexer) LexDirective() (string, bool) {
+	start := bytes.LastIndexByte(l.Contents[:l.Position], '\n') + 1
+	if len(bytes.TrimSpace(l.Contents[start:l.Position])) != 0 {
+		return "", false
+	}
+	line := l.Contents[l.Position+1:]
+	if end := strings.IndexByte(string(line), '\n'); end >= 0 {
+		line = line[:end]
+	}
+	directive, _, _ := strings.Cut(string(line), "#")
+	fields := strings.Fields(directive)
+	if len(fields) == 0 || !strings.HasPrefix(directive, fields[0]) {
+		return "", false
+	}
+	switch {
+	case fields[0] == "if" && len(fields) == 2:
+	case (fields[0] == "else" || fields[0] == "end") && len(fields) == 1:
+	default:
+		return "", false
+	}
+
+	for range line {
+		l.Move()
+	}
+	l.Move()
+	return strings.Join(fields, " "), true
 }
 
-func (l *Lexer) NewError(format string, a ...any) {
-	l.Errors = append(l.Errors, fmt.Errorf(format, a...))
+func (l *Lexer) NewError(row, col int, format string, a ...any) {
+	l.Diagnostics.Error(l.Filename, row, col, format, a...)
+}
+
+// operators is sorted so that longer operators are matched before their
+// prefixes.
+var operators = []string{"[]=", ">>>", "[]", "->", ":=", "<<", ">>", "<=", ">=", "!=", "+", "-", "*", "/", "%", "=", "<", ">", "!", "&", "|", "^", "~", "@"}
+
+func (l *Lexer) LexOp() string {
+	rest := string(l.Contents[l.Position:min(l.Position+3, len(l.Contents))])
+	for _, op := range operators {
+		if strings.HasPrefix(rest, op) {
+			for range op {
+				l.Move()
+			}
+			return op
+		}
+	}
+	return ""
 }
 
 func (l *Lexer) IsOp() bool {
 	ch := l.Peek()
-	ops := []byte{'+', '-', '*', '/', '=', '<', '>', '!'}
+	ops := []byte{'+', '-', '*', '/', '%', '=', '<', '>', '!', '&', '|', '^', '~', '@', '[', ':'}
 	for _, op := range ops {
 		if ch == op {
 			return true
@@ -178,8 +397,11 @@ func (l *Lexer) IsInt() bool {
 }
 
 func (l *Lexer) IsAlpha() bool {
-	ch := l.Peek()
-	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch < 'Z') || ch == '_'
+	return isAlpha(l.Peek())
+}
+
+func isAlpha(ch byte) bool {
+	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ch == '_'
 }
 
 func (l *Lexer) LexToken() {
@@ -197,27 +419,45 @@ func (l *Lexer) LexToken() {
 	if l.IsInt() {
 		value := l.LexInt()
 		l.Tokens.AppendToken(INT, value, row, col)
+	} else if ch == '-' && '0' <= l.PeekNext() && l.PeekNext() <= '9' {
+		value := l.LexInt()
+		l.Tokens.AppendToken(INT, value, row, col)
 	} else if l.IsOp() {
-		l.Tokens.AppendToken(OPERATOR, string(ch), row, col)
-		l.Move()
+		op := l.LexOp()
+		if op == "" {
+			l.NewError(row, col, "Unknown character : `%c`", ch)
+			l.Move()
+			return
+		}
+		l.Tokens.AppendToken(OPERATOR, op, row, col)
 	} else if ch == '#' {
-		for l.Peek() != '\n' {
+		if directive, ok := l.LexDirective(); ok {
+			l.Tokens.AppendToken(DIRECTIVE, directive, row, col)
+			return
+		}
+		for !l.AtEnd() && l.Peek() != '\n' {
 			l.Move()
 		}
 	} else if ch == '"' {
-		var str string
+		var str []byte
 		l.Move()
 		for l.Peek() != '"' {
 			char := l.Peek()
-			if char == '\n' {
-				l.NewError("%d:%d %s Error: Unclosed string", row, col, l.Filename)
+			if char == '\n' || l.AtEnd() {
+				l.NewError(row, col, "Unclosed string")
 				break
 			}
-			str += string(char)
+			if char == '\\' {
+				str = append(str, l.LexEscape())
+				continue
+			}
+			str = append(str, char)
 			l.Move()
 		}
-		l.Tokens.AppendToken(STRING, str, row, col)
+		l.Tokens.AppendToken(STRING, string(str), row, col)
 		l.Move()
+	} else if ch == '\'' {
+		l.LexChar()
 	} else if l.IsAlpha() {
 		var str string
 		for l.IsAlpha() || l.IsInt() {
@@ -225,6 +465,19 @@ func (l *Lexer) LexToken() {
 			l.Move()
 		}
 
+		for l.Peek() == '.' && isAlpha(l.PeekNext()) {
+			str += "."
+			l.Move()
+			for l.IsAlpha() || l.IsInt() {
+				str += string(l.Peek())
+				l.Move()
+			}
+		}
+		if strings.Contains(str, ".") {
+			l.Tokens.AppendToken(FIELD, str, row, col)
+			return
+		}
+
 		switch str {
 		case "true", "false":
 			l.Tokens.AppendToken(BOOL, str, row, col)
@@ -232,17 +485,24 @@ func (l *Lexer) LexToken() {
 			for l.IsSpace() {
 				l.Move()
 			}
-			if !l.IsInt() {
-				l.NewError("%d:%d %s Error: Expected integer got : `%c`", l.Row, l.Col, l.Filename, l.Peek())
+			var value string
+			if l.IsAlpha() {
+				for l.IsAlpha() || l.IsInt() {
+					value += string(l.Peek())
+					l.Move()
+				}
+			} else if l.IsInt() {
+				value = l.LexInt()
+			} else {
+				l.NewError(l.Row, l.Col, "Expected integer got : `%c`", l.Peek())
 			}
-			value := l.LexInt()
 			l.Tokens.AppendToken(SYSCALL, value, row, col)
 		case "proc":
 			for l.IsSpace() {
 				l.Move()
 			}
 			if !l.IsAlpha() {
-				l.NewError("%d:%d %s Error: Expected ident got : `%c`", l.Row, l.Col, l.Filename, l.Peek())
+				l.NewError(l.Row, l.Col, "Expected ident got : `%c`", l.Peek())
 			}
 			var value string
 			for l.IsAlpha() || l.IsInt() {
@@ -255,6 +515,13 @@ func (l *Lexer) LexToken() {
 					l.Move()
 				}
 
+				if l.Peek() == '-' && l.PeekNext() == '>' {
+					l.Move()
+					l.Move()
+					l.LexReturns()
+					break
+				}
+
 				row, col = l.Row, l.Col
 				kind, name := l.LexArg()
 				l.Tokens.AppendToken(kind, name, row, col)
@@ -262,6 +529,23 @@ func (l *Lexer) LexToken() {
 					break
 				}
 			}
+		case "sizeof":
+			if l.Peek() != '(' {
+				l.NewError(l.Row, l.Col, "Expected `(` after `sizeof`")
+				return
+			}
+			l.Move()
+			var value string
+			for l.IsAlpha() || l.IsInt() {
+				value += string(l.Peek())
+				l.Move()
+			}
+			if l.Peek() != ')' {
+				l.NewError(l.Row, l.Col, "Expected `)` after `sizeof(%s`", value)
+				return
+			}
+			l.Move()
+			l.Tokens.AppendToken(SIZEOF, value, row, col)
 		case "import":
 			for l.IsSpace() {
 				l.Move()
@@ -272,19 +556,20 @@ func (l *Lexer) LexToken() {
 				l.Move()
 			}
 			l.Tokens.AppendToken(IMPORT, value, row, col)
-		case "dup", "drop", "swap", "inc", "dec", "dump", "return", "if", "end", "else", "while", "do", "derefc", "derefi", "buffer":
+		case "dup", "drop", "swap", "inc", "dec", "dump", "return", "if", "end", "else", "elif", "while", "for", "step", "match", "case", "default", "do", "break", "continue", "derefc", "derefw", "derefd", "derefi", "storec", "storew", "stored", "storei", "buffer", "const", "var", "struct", "macro", "asm", "let", "in", "divmod", "neg", "and", "or", "not":
 			l.Tokens.AppendToken(KEYWORD, str, row, col)
 		default:
 			l.Tokens.AppendToken(CALL, str, row, col)
 		}
 	} else {
-		l.NewError("%d:%d %s Error: Unknown character : `%c`", row, col, l.Filename, ch)
+		l.NewError(row, col, "Unknown character : `%c`", ch)
 		l.Move()
 	}
 }
 
-func (l *Lexer) Lex() {
+func (l *Lexer) Lex() diag.Diagnostics {
 	for !l.AtEnd() {
 		l.LexToken()
 	}
+	return l.Diagnostics
 }
@@ -4,6 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"xyl/src/checker"
+	"xyl/src/codegen"
 	"xyl/src/lexer"
 	"xyl/src/parser"
 )
@@ -15,15 +19,66 @@ func usage() {
 	fmt.Printf("  %s [options] <filename>\n", os.Args[0])
 	fmt.Println()
 	fmt.Println("Options:")
-	fmt.Println("  -c, --clean      Clean the .o and .asm files after compilation of the program")
-	fmt.Println("  -h, --help       Show this help message")
-	fmt.Println("      --version    Show current version")
+	fmt.Println("  -c, --clean         Clean the .o and .asm files after compilation of the program")
+	fmt.Println("      --bounds-check  Exit with an error when an array index is out of bounds")
+	fmt.Println("  -h, --help          Show this help message")
+	fmt.Println("      --target        Target platform as os/arch, defaults to linux/x86_64")
+	fmt.Println("      --version       Show current version")
+}
+
+func build(filename, code string, clean bool) {
+	baseName := filepath.Base(filename)
+	ext := filepath.Ext(filename)
+
+	fileName := baseName[:len(baseName)-len(ext)]
+	fileOut := fileName + ".asm"
+	err := os.WriteFile(fileOut, []byte(code), 0644)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	as := exec.Command("as", "-o", fileName+".o", fileOut)
+	output, err := as.Output()
+	if err != nil {
+		fmt.Println("Error while compiling ", fileOut)
+		fmt.Println(output)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ld := exec.Command("ld", "-o", fileName, fileName+".o")
+	output, err = ld.Output()
+	if err != nil {
+		fmt.Println("Error while linking ", fileName, ".o")
+		fmt.Println(output)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if clean {
+		err = os.Remove(fileOut)
+		if err != nil {
+			fmt.Println("Error while removing ", fileOut)
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		err = os.Remove(fileName + ".o")
+		if err != nil {
+			fmt.Println("Error while removing ", fileName, ".o")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 }
 
 func main() {
 	cLong := flag.Bool("clean", false, "")
 	cShort := flag.Bool("c", false, "")
 	version := flag.Bool("version", false, "")
+	boundsCheck := flag.Bool("bounds-check", false, "")
+	targetName := flag.String("target", parser.DEFAULT_TARGET.String(), "")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -38,6 +93,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	target, err := parser.ParseTarget(*targetName)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
 	filename := flag.Arg(0)
 	clean := *cLong || *cShort
 
@@ -49,5 +110,22 @@ func main() {
 	}
 	l.Lex()
 
-	parser.Parse(*l, []string{})
+	prog, diagnostics := parser.Parse(*l, target)
+	if !diagnostics.HasErrors() {
+		diagnostics = append(diagnostics, checker.Check(prog)...)
+	}
+	for _, d := range diagnostics {
+		fmt.Println(d.Error())
+	}
+	if diagnostics.HasErrors() {
+		os.Exit(1)
+	}
+
+	if target != parser.DEFAULT_TARGET {
+		fmt.Printf("Error: Code generation for `%s` is not supported yet, only `%s` is\n", target, parser.DEFAULT_TARGET)
+		os.Exit(1)
+	}
+
+	code := codegen.Generate(prog, codegen.Options{BoundsCheck: *boundsCheck})
+	build(filename, code, clean)
 }
@@ -1,551 +1,1405 @@
 package parser
 
 import (
-	"crypto/rand"
 	"fmt"
-	"math/big"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"xyl/src/ast"
+	"xyl/src/diag"
 	"xyl/src/lexer"
 )
 
+// Symbols is shared by every file taking part in a compilation so that
+// procedures and buffers are visible across imports.
+type Symbols struct {
+	XylHome     string
+	Target      Target
+	Libs        []string
+	Functions   map[string]*ast.Proc
+	Buffers     map[string]*ast.Buffer
+	Consts      map[string]*ast.Const
+	Vars        map[string]*ast.Var
+	Structs     map[string]*ast.Struct
+	Macros      map[string]*Macro
+	Diagnostics diag.Diagnostics
+}
+
+// Macro keeps the tokens of a macro body together with the file they came
+// from so they can be parsed at every expansion site.
+type Macro struct {
+	Node     *ast.Macro
+	Filename string
+	Tokens   lexer.Tokens
+}
+
+// MAX_EXPANSION_DEPTH limits how deep macros can expand inside each other and
+// MAX_EXPANSIONS how many expansions a file may produce in total, macros which
+// use each other several times would otherwise grow exponentially.
 const (
-	upper  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	lower  = "abcdefghijklmnopqrstuvwxyz"
-	digits = "0123456789"
-
-	printNumText = `dump:
-  pushq %rbp
-  movq %rsp, %rbp
-  subq $64, %rsp
-  movq %rdi, -56(%rbp)
-  movq $1, -8(%rbp)
-  movl $32, %eax
-  subq -8(%rbp), %rax
-  movb $10, -48(%rbp,%rax)
-.L2:
-  movq -56(%rbp), %rcx
-  movabsq $-3689348814741910323, %rdx
-  movq %rcx, %rax
-  mulq %rdx
-  shrq $3, %rdx
-  movq %rdx, %rax
-  salq $2, %rax
-  addq %rdx, %rax
-  addq %rax, %rax
-  subq %rax, %rcx
-  movq %rcx, %rdx
-  movl %edx, %eax
-  leal 48(%rax), %edx
-  movl $31, %eax
-  subq -8(%rbp), %rax
-  movb %dl, -48(%rbp,%rax)
-  addq $1, -8(%rbp)
-  movq -56(%rbp), %rax
-  movabsq $-3689348814741910323, %rdx
-  mulq %rdx
-  movq %rdx, %rax
-  shrq $3, %rax
-  movq %rax, -56(%rbp)
-  cmpq $0, -56(%rbp)
-  jne .L2
-  movl $32, %eax
-  subq -8(%rbp), %rax
-  leaq -48(%rbp), %rdx
-  leaq (%rdx,%rax), %rcx
-  movq -8(%rbp), %rax
-  movq %rax, %rdx
-  movq %rcx, %rsi
-  movl $1, %edi
-  movl $0, %eax
-  movq $1,%rax
-  syscall
-  nop
-  leave
-  ret`
+	MAX_EXPANSION_DEPTH = 64
+	MAX_EXPANSIONS      = 1 << 20
 )
 
-type Label struct {
-	Name    string
-	HasElse bool
-	IsWhile bool
-	IsFunc  bool
+// blockOpeners are the instructions closed by an `end`, they are counted to
+// find the `end` of a macro body.
+var blockOpeners = []string{"if", "while", "for", "match", "let", "const", "struct", "macro", "asm"}
+
+type Parser struct {
+	Filename   string
+	Tokens     lexer.Tokens
+	Position   int
+	Symbols    *Symbols
+	proc       *ast.Proc
+	locals     []*ast.Local
+	expansions []*ast.Expansion
+	expanded   int
+	loops      []ast.Node
+}
+
+func strContains(list []string, target string) bool {
+	for _, i := range list {
+		if i == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse builds the syntax tree of a lexed file and every library it imports.
+// Diagnostics of the lexer are carried over and parsing continues past
+// recoverable errors, so the returned program is only usable when the
+// diagnostics contain no errors.
+func Parse(lex lexer.Lexer, target Target) (*ast.Program, diag.Diagnostics) {
+	symbols := &Symbols{
+		XylHome:     os.Getenv("XYL_HOME"),
+		Target:      target,
+		Libs:        []string{},
+		Functions:   make(map[string]*ast.Proc),
+		Buffers:     make(map[string]*ast.Buffer),
+		Consts:      make(map[string]*ast.Const),
+		Structs:     make(map[string]*ast.Struct),
+		Macros:      make(map[string]*Macro),
+		Vars:        make(map[string]*ast.Var),
+		Diagnostics: diag.Diagnostics{},
+	}
+	prog := parseFile(lex, symbols)
+	return prog, symbols.Diagnostics
 }
 
-type Function struct {
-	Name string
-	Args map[string]int
+func parseFile(lex lexer.Lexer, symbols *Symbols) *ast.Program {
+	symbols.Diagnostics = append(symbols.Diagnostics, lex.Diagnostics...)
+
+	p := &Parser{
+		Filename: lex.Filename,
+		Tokens:   lex.Tokens,
+		Position: 0,
+		Symbols:  symbols,
+	}
+	p.Tokens = p.Preprocess(p.Tokens)
+	return p.ParseProgram()
 }
 
-func randLabel(length int, chars string) (string, error) {
-	result := make([]byte, length)
-	for i := range result {
-		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
-		if err != nil {
-			return "", err
+// Target is the platform the program is compiled for, it decides which
+// branches of `#if` directives are kept.
+type Target struct {
+	OS   string
+	Arch string
+}
+
+var (
+	DEFAULT_TARGET = Target{OS: "linux", Arch: "x86_64"}
+	TARGET_OS      = []string{"linux", "macos"}
+	TARGET_ARCH    = []string{"x86_64", "arm64"}
+)
+
+// ParseTarget reads a target written as `os/arch`.
+func ParseTarget(name string) (Target, error) {
+	system, arch, _ := strings.Cut(name, "/")
+	if !strContains(TARGET_OS, system) || !strContains(TARGET_ARCH, arch) {
+		return Target{}, fmt.Errorf("Unknown target `%s`, expected one of `%s` followed by `/` and one of `%s`", name, strings.Join(TARGET_OS, "`, `"), strings.Join(TARGET_ARCH, "`, `"))
+	}
+	return Target{OS: system, Arch: arch}, nil
+}
+
+func (t Target) String() string {
+	return t.OS + "/" + t.Arch
+}
+
+// Matches reports whether the condition of an `#if` holds, it names an
+// operating system, an architecture or both as `os/arch`.
+func (t Target) Matches(condition string) bool {
+	if system, arch, ok := strings.Cut(condition, "/"); ok {
+		return system == t.OS && arch == t.Arch
+	}
+	return condition == t.OS || condition == t.Arch
+}
+
+// Preprocess drops the tokens inside `#if` branches that don't match the
+// target, directives can be nested.
+func (p *Parser) Preprocess(tokens lexer.Tokens) lexer.Tokens {
+	type branch struct {
+		token  lexer.Token
+		active bool
+		taken  bool
+		inElse bool
+	}
+	var result lexer.Tokens
+	var branches []branch
+	active := func() bool {
+		return len(branches) == 0 || branches[len(branches)-1].active
+	}
+
+	for _, token := range tokens {
+		if token.Kind != lexer.DIRECTIVE {
+			if active() {
+				result = append(result, token)
+			}
+			continue
+		}
+
+		name, condition, _ := strings.Cut(token.Value, " ")
+		switch name {
+		case "if":
+			condition = strings.TrimSpace(condition)
+			known := false
+			if system, arch, ok := strings.Cut(condition, "/"); ok {
+				known = strContains(TARGET_OS, system) && strContains(TARGET_ARCH, arch)
+			} else {
+				known = strContains(TARGET_OS, condition) || strContains(TARGET_ARCH, condition)
+			}
+			if !known {
+				p.Error(token, "Unknown target in `#if` : `%s`", condition)
+			}
+			matches := p.Symbols.Target.Matches(condition)
+			branches = append(branches, branch{token: token, active: active() && matches, taken: matches})
+		case "else":
+			if len(branches) == 0 {
+				p.Error(token, "`#else` without `#if`")
+				continue
+			}
+			b := &branches[len(branches)-1]
+			if b.inElse {
+				p.Error(token, "Duplicate `#else` for `#if`")
+			}
+			b.inElse = true
+			b.active = !b.taken && (len(branches) == 1 || branches[len(branches)-2].active)
+		case "end":
+			if len(branches) == 0 {
+				p.Error(token, "`#end` without `#if`")
+				continue
+			}
+			branches = branches[:len(branches)-1]
 		}
-		result[i] = chars[n.Int64()]
 	}
-	return string(result), nil
+	for _, b := range branches {
+		p.Error(b.token, "Missing `#end` for `#%s`", b.token.Value)
+	}
+	return result
 }
 
-func contains(list []Function, target Function) bool {
-	for _, i := range list {
-		if i.Name == target.Name {
-			return true
+func (p *Parser) AtEnd() bool {
+	return p.Position >= len(p.Tokens)
+}
+
+func (p *Parser) Peek() (lexer.Token, bool) {
+	if p.AtEnd() {
+		return lexer.Token{}, false
+	}
+	return p.Tokens[p.Position], true
+}
+
+func (p *Parser) Next() lexer.Token {
+	token := p.Tokens[p.Position]
+	p.Position++
+	return token
+}
+
+func (p *Parser) Pos(token lexer.Token) ast.Pos {
+	return ast.Pos{File: p.Filename, Row: token.Row, Col: token.Col}
+}
+
+func (p *Parser) Error(token lexer.Token, format string, a ...any) {
+	p.Report(diag.New(diag.ERROR, p.Filename, token.Row, token.Col, format, a...))
+}
+
+// Report records a diagnostic, inside a macro expansion every expansion
+// site leading to it is attached as a note.
+func (p *Parser) Report(d diag.Diagnostic) {
+	for i := len(p.expansions) - 1; i >= 0; i-- {
+		site := p.expansions[i]
+		d = d.WithNote(site.File, site.Row, site.Col, "In expansion of macro `%s`", site.Macro.Name)
+	}
+	p.Symbols.Diagnostics.Add(d)
+}
+
+// Redefined reports a duplicate name together with a note pointing at the
+// original definition.
+func (p *Parser) Redefined(token lexer.Token, what string, prev ast.Pos) {
+	d := diag.New(diag.ERROR, p.Filename, token.Row, token.Col, "Duplicate %s : `%s`", what, token.Value)
+	p.Report(d.WithNote(prev.File, prev.Row, prev.Col, "`%s` first defined here", token.Value))
+}
+
+func (p *Parser) ParseProgram() *ast.Program {
+	prog := &ast.Program{Pos: ast.Pos{File: p.Filename, Row: 1, Col: 1}}
+	for !p.AtEnd() {
+		token := p.Next()
+		var node ast.Node
+		switch token.Kind {
+		case lexer.IMPORT:
+			node = p.ParseImport(token)
+		case lexer.PROC:
+			node = p.ParseProc(token)
+		default:
+			node = p.ParseInstr(token)
+		}
+		if node != nil {
+			prog.Body = append(prog.Body, node)
 		}
 	}
-	return false
+	return prog
 }
 
-func containsArg(list []Function, target string) bool {
-	for _, i := range list {
-		if _, ok := i.Args[target]; ok {
-			return true
+// ParseBlock collects instructions until one of the terminating keywords is
+// reached, the terminator is consumed and returned alongside the block.
+func (p *Parser) ParseBlock(opener lexer.Token, terminators ...string) ([]ast.Node, lexer.Token) {
+	var body []ast.Node
+	for !p.AtEnd() {
+		token := p.Next()
+		if token.Kind == lexer.KEYWORD && strContains(terminators, token.Value) {
+			return body, token
+		}
+		if node := p.ParseInstr(token); node != nil {
+			body = append(body, node)
 		}
 	}
-	return false
+	missing := strings.Join(terminators, "` or `")
+	if opener.Kind == lexer.PROC {
+		p.Error(opener, "Missing `%s` for procedure `%s`", missing, opener.Value)
+	} else {
+		p.Error(opener, "Missing `%s` for `%s` instruction", missing, opener.Value)
+	}
+	return body, opener
 }
 
-func containsStr(list []Function, target string) bool {
-	for _, i := range list {
-		if i.Name == target {
-			return true
+func (p *Parser) ParseImport(token lexer.Token) ast.Node {
+	node := &ast.Import{Pos: p.Pos(token), Path: token.Value}
+	if token.Value == "" {
+		p.Error(token, "Import statement missing library")
+		return node
+	}
+
+	libPath, ok := p.FindLib(token.Value)
+	if !ok {
+		d := diag.New(diag.ERROR, p.Filename, token.Row, token.Col, "Imported library could not be found : `%s`", token.Value)
+		if p.Symbols.XylHome == "" {
+			d = d.WithNote("", 0, 0, "Could not find `XYL_HOME` env variable")
 		}
+		p.Symbols.Diagnostics.Add(d)
+		return node
 	}
-	return false
+
+	if strContains(p.Symbols.Libs, libPath) {
+		return node
+	}
+	p.Symbols.Libs = append(p.Symbols.Libs, libPath)
+
+	l, err := lexer.NewLexer(libPath, true, false)
+	if err != nil {
+		p.Error(token, "Could not compile lib `%s` : %s", libPath, err.Error())
+		return node
+	}
+	l.Lex()
+	node.Program = parseFile(*l, p.Symbols)
+	return node
 }
 
-func strContains(list []string, target string) bool {
-	for _, i := range list {
-		if i == target {
-			return true
+// FindLib resolves a dotted import path, first against the standard library
+// in `$XYL_HOME/lib` and then against the working directory.
+func (p *Parser) FindLib(name string) (string, bool) {
+	parts := strings.Split(name, ".")
+	if p.Symbols.XylHome != "" {
+		libPath := filepath.Join(p.Symbols.XylHome, "lib", filepath.Join(parts...)) + ".xyl"
+		if _, err := os.Stat(libPath); err == nil {
+			return libPath, true
 		}
 	}
-	return false
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		return "", false
+	}
+	modulePath := filepath.Join(pwd, filepath.Join(parts...)) + ".xyl"
+	if _, err := os.Stat(modulePath); err != nil {
+		return "", false
+	}
+	return modulePath, true
 }
 
-func findFunc(list []Function, target string) Function {
-	for _, i := range list {
-		if i.Name == target {
-			return i
-		}
-	}
-	return Function{}
-}
-
-func Parse(lex lexer.Lexer, libs []string) (string, string, string, []Function, []string, []string) {
-	if len(lex.Errors) != 0 {
-		for _, err := range lex.Errors {
-			fmt.Println(err)
-		}
-		os.Exit(1)
-	}
-
-	xylHome := os.Getenv("XYL_HOME")
-	if xylHome == "" {
-		fmt.Println("Error: Could not find `XYL_HOME` env variable")
-		os.Exit(1)
-	}
-
-	registers := []string{"rax", "rdi", "rsi", "rdx", "r10", "r8", "r9"}
-	var text, data, bss string
-	var functions []Function
-	var ifQueue []Label
-	var funcQueue []Function
-	var buffers []string
-
-	for i := 0; i < len(lex.Tokens); i++ {
-		token := lex.Tokens[i]
-		if token.Kind == lexer.INT {
-			text += "\t## PUSH ##\n"
-			text += fmt.Sprintf("\tmovq $%s, %%rax\n", token.Value)
-			text += "\tpush %rax\n"
-		} else if token.Kind == lexer.OPERATOR {
-			switch token.Value {
-			case "+":
-				text += "\t## ADD ##\n"
-				text += "\tpop %rbx\n\tpop %rax\n"
-				text += "\taddq %rbx, %rax\n"
-				text += "\tpush %rax\n"
-			case "-":
-				text += "\t## SUB ##\n"
-				text += "\tpop %rbx\n\tpop %rax\n"
-				text += "\tsubq %rbx, %rax\n"
-				text += "\tpush %rax\n"
-			case "*":
-				text += "\t## MUL ##\n"
-				text += "\tpop %rbx\n\tpop %rax\n"
-				text += "\timulq %rbx\n"
-				text += "\tpush %rax\n"
-			case "/":
-				fmt.Println("Division not implemented")
-				os.Exit(1)
-			case "=":
-				text += "\t## EQUAL ##\n"
-				text += "\tpop %rax\n"
-				text += "\tpop %rbx\n"
-				text += "\txor %rcx, %rcx\n"
-				text += "\tmovq $1, %rdx\n"
-				text += "\tcmpq %rax, %rbx\n"
-				text += "\tcmove %rdx, %rcx\n"
-				text += "\tpush %rcx\n"
-			case "!":
-				text += "\t## NOT EQUAL ##\n"
-				text += "\tpop %rax\n"
-				text += "\tpop %rbx\n"
-				text += "\txor %rcx, %rcx\n"
-				text += "\tmovq $1, %rdx\n"
-				text += "\tcmpq %rax, %rbx\n"
-				text += "\tcmovne %rdx, %rcx\n"
-				text += "\tpush %rcx\n"
-			case "<":
-				text += "\t## LESS THAN ##\n"
-				text += "\tpop %rax\n"
-				text += "\tpop %rbx\n"
-				text += "\txor %rcx, %rcx\n"
-				text += "\tmovq $1, %rdx\n"
-				text += "\tcmpq %rax, %rbx\n"
-				text += "\tcmovl %rdx, %rcx\n"
-				text += "\tpush %rcx\n"
-			case ">":
-				text += "\t## GREATER THAN ##\n"
-				text += "\tpop %rax\n"
-				text += "\tpop %rbx\n"
-				text += "\txor %rcx, %rcx\n"
-				text += "\tmovq $1, %rdx\n"
-				text += "\tcmpq %rax, %rbx\n"
-				text += "\tcmovg %rdx, %rcx\n"
-				text += "\tpush %rcx\n"
+func (p *Parser) ParseProc(token lexer.Token) ast.Node {
+	// TODO: Make sure the user cant use reserved keywords
+	proc := &ast.Proc{Pos: p.Pos(token), Name: token.Value}
+	if prev, ok := p.Lookup(token.Value); ok {
+		p.Redefined(token, "name", prev)
+	}
+
+	for !p.AtEnd() {
+		arg := p.Next()
+		if arg.Kind == lexer.VOID_ARG {
+			break
+		}
+
+		if arg.Kind == lexer.RETURN_TYPE {
+			p.ParseReturnType(proc, arg)
+			continue
+		}
+
+		var kind ast.Type
+		switch arg.Kind {
+		case lexer.BOOL_ARG:
+			kind = ast.BOOL
+		case lexer.CHAR_ARG:
+			kind = ast.CHAR
+		case lexer.INT_ARG:
+			kind = ast.INT
+		case lexer.PTR_ARG:
+			kind = ast.PTR
+		default:
+			p.Error(arg, "Unknown argument : `%s`", arg.Value)
+			continue
+		}
+		if index, ok := proc.ArgIndex(arg.Value); ok {
+			p.Redefined(arg, "argument name", proc.Args[index].Pos)
+			continue
+		}
+		proc.Args = append(proc.Args, ast.Arg{Pos: p.Pos(arg), Name: arg.Value, Type: kind})
+	}
+	if _, ok := p.Lookup(proc.Name); !ok {
+		p.Symbols.Functions[proc.Name] = proc
+	}
+
+	outer, locals, loops := p.proc, p.locals, p.loops
+	p.proc, p.locals, p.loops = proc, nil, nil
+	var end lexer.Token
+	proc.Body, end = p.ParseBlock(token, "end")
+	proc.EndPos = p.Pos(end)
+	p.proc, p.locals, p.loops = outer, locals, loops
+	return proc
+}
+
+// ParseReturnType records one of the types listed after `->` in a signature,
+// `void` declares a procedure that leaves nothing on the stack.
+func (p *Parser) ParseReturnType(proc *ast.Proc, token lexer.Token) {
+	if proc.Declared && (token.Value == "void" || len(proc.Returns) == 0) {
+		p.Error(token, "`void` can not be combined with other return types")
+		return
+	}
+	proc.Declared = true
+	if token.Value == "void" {
+		return
+	}
+	if len(proc.Returns) == ast.MAX_RETURNS {
+		p.Error(token, "Procedure `%s` can return at most %d values", proc.Name, ast.MAX_RETURNS)
+		return
+	}
+	proc.Returns = append(proc.Returns, ast.ParseType(token.Value))
+}
+
+// Lookup returns where a global name is defined, procedures, buffers and
+// constants share one namespace.
+func (p *Parser) Lookup(name string) (ast.Pos, bool) {
+	if proc, ok := p.Symbols.Functions[name]; ok {
+		return proc.Pos, true
+	}
+	if buffer, ok := p.Symbols.Buffers[name]; ok {
+		return buffer.Pos, true
+	}
+	if c, ok := p.Symbols.Consts[name]; ok {
+		return c.Pos, true
+	}
+	if v, ok := p.Symbols.Vars[name]; ok {
+		return v.Pos, true
+	}
+	if s, ok := p.Symbols.Structs[name]; ok {
+		return s.Pos, true
+	}
+	if m, ok := p.Symbols.Macros[name]; ok {
+		return m.Node.Pos, true
+	}
+	return ast.Pos{}, false
+}
+
+// IntValue returns the value of an integer literal, of a name referring to
+// a constant, of `sizeof(Name)` or of a `Name.field` offset.
+func (p *Parser) IntValue(token lexer.Token) (int64, bool) {
+	switch token.Kind {
+	case lexer.SIZEOF:
+		if s, ok := p.Symbols.Structs[token.Value]; ok {
+			return int64(s.Size), true
+		}
+		return 0, false
+	case lexer.FIELD:
+		_, offset, ok := p.Field(token, false)
+		return int64(offset), ok
+	}
+	if c, ok := p.Symbols.Consts[token.Value]; ok {
+		return c.Value, true
+	}
+	if token.Kind != lexer.INT && token.Kind != lexer.SYSCALL {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(token.Value, 10, 64)
+	return value, err == nil
+}
+
+// ParseConst evaluates the body of `const NAME ... end` on a compile time
+// stack, the body may use integer and character literals, other constants,
+// the arithmetic and bitwise operators and `neg`.
+func (p *Parser) ParseConst(token lexer.Token) ast.Node {
+	if p.AtEnd() {
+		p.Error(token, "Expected constant name")
+		return nil
+	}
+	name := p.Next()
+	if name.Kind != lexer.CALL {
+		p.Error(name, "Expected constant name got `%s` instead", name.Value)
+	}
+
+	var stack []int64
+	ok := name.Kind == lexer.CALL
+	for {
+		if p.AtEnd() {
+			p.Error(token, "Missing `end` for constant `%s`", name.Value)
+			return nil
+		}
+		value := p.Next()
+		if value.Kind == lexer.KEYWORD && value.Value == "end" {
+			break
+		}
+		if ok {
+			ok = p.EvalConst(value, &stack)
+		}
+	}
+	if !ok {
+		return nil
+	}
+	if len(stack) != 1 {
+		p.Error(token, "Constant `%s` must evaluate to exactly one value got %d", name.Value, len(stack))
+		return nil
+	}
+	if prev, found := p.Lookup(name.Value); found {
+		p.Redefined(name, "name", prev)
+		return nil
+	}
+
+	c := &ast.Const{Pos: p.Pos(token), Name: name.Value, Value: stack[0]}
+	p.Symbols.Consts[c.Name] = c
+	return c
+}
+
+// EvalConst applies a single token of a constant expression to the stack,
+// it reports the error and returns false when the token can't be evaluated.
+func (p *Parser) EvalConst(token lexer.Token, stack *[]int64) bool {
+	pop := func(n int) []int64 {
+		if len(*stack) < n {
+			return nil
+		}
+		values := append([]int64{}, (*stack)[len(*stack)-n:]...)
+		*stack = (*stack)[:len(*stack)-n]
+		return values
+	}
+
+	switch {
+	case token.Kind == lexer.CHAR:
+		value, _ := strconv.ParseInt(token.Value, 10, 64)
+		*stack = append(*stack, value)
+		return true
+	case token.Kind == lexer.SIZEOF || token.Kind == lexer.FIELD:
+		value, ok := p.IntValue(token)
+		if !ok {
+			p.UnknownStruct(token)
+			return false
+		}
+		*stack = append(*stack, value)
+		return true
+	case token.Kind == lexer.INT || token.Kind == lexer.CALL:
+		value, ok := p.IntValue(token)
+		if !ok {
+			p.Error(token, "Unknown constant `%s`", token.Value)
+			return false
+		}
+		*stack = append(*stack, value)
+		return true
+	case token.Kind == lexer.KEYWORD && token.Value == "neg", token.Kind == lexer.OPERATOR && token.Value == "~":
+		values := pop(1)
+		if values == nil {
+			p.Error(token, "Not enough values for `%s` in constant", token.Value)
+			return false
+		}
+		if token.Value == "neg" {
+			*stack = append(*stack, -values[0])
+		} else {
+			*stack = append(*stack, ^values[0])
+		}
+		return true
+	case token.Kind == lexer.OPERATOR:
+		values := pop(2)
+		if values == nil {
+			p.Error(token, "Not enough values for `%s` in constant", token.Value)
+			return false
+		}
+		a, b := values[0], values[1]
+		var result int64
+		switch token.Value {
+		case "+":
+			result = a + b
+		case "-":
+			result = a - b
+		case "*":
+			result = a * b
+		case "/", "%":
+			if b == 0 {
+				p.Error(token, "Division by zero in `%s`", token.Value)
+				return false
 			}
-		} else if token.Kind == lexer.BOOL {
-			if token.Value == "true" {
-				text += "\t## TRUE ##\n"
-				text += "\tmovq $1, %rax\n"
-				text += "\tpush %rax\n"
-			} else if token.Value == "false" {
-				text += "\t## FALSE ##\n"
-				text += "\tmovq $0, %rax\n"
-				text += "\tpush %rax\n"
+			if token.Value == "/" {
+				result = a / b
+			} else {
+				result = a % b
 			}
-		} else if token.Kind == lexer.SYSCALL {
-			num, err := strconv.Atoi(token.Value)
-			if err != nil {
-				fmt.Printf("%d:%d %s Error: Invalid number : `%s`\n", token.Row, token.Col, lex.Filename, token.Value)
-				os.Exit(1)
+		case "&":
+			result = a & b
+		case "|":
+			result = a | b
+		case "^":
+			result = a ^ b
+		case "<<":
+			result = a << (b & 63)
+		case ">>":
+			result = a >> (b & 63)
+		case ">>>":
+			result = int64(uint64(a) >> (b & 63))
+		default:
+			p.Error(token, "Operator `%s` is not allowed in constants", token.Value)
+			return false
+		}
+		*stack = append(*stack, result)
+		return true
+	}
+	p.Error(token, "`%s` is not allowed in constants", token.Value)
+	return false
+}
+
+// ParseMacro records the tokens of `macro name ... end`, nested blocks are
+// kept intact by counting the instructions that are closed by `end`.
+func (p *Parser) ParseMacro(token lexer.Token) ast.Node {
+	if p.proc != nil || len(p.expansions) > 0 {
+		p.Error(token, "`macro` is only allowed at the top level")
+	}
+	if p.AtEnd() {
+		p.Error(token, "Expected macro name")
+		return nil
+	}
+	name := p.Next()
+	ok := name.Kind == lexer.CALL
+	if !ok {
+		p.Error(name, "Expected macro name got `%s` instead", name.Value)
+	}
+
+	macro := &Macro{Node: &ast.Macro{Pos: p.Pos(token), Name: name.Value}, Filename: p.Filename}
+	depth := 0
+	for {
+		if p.AtEnd() {
+			p.Error(token, "Missing `end` for macro `%s`", name.Value)
+			return nil
+		}
+		body := p.Next()
+		if body.Kind == lexer.PROC || body.Kind == lexer.KEYWORD && strContains(blockOpeners, body.Value) {
+			depth++
+		} else if body.Kind == lexer.KEYWORD && body.Value == "end" {
+			if depth == 0 {
+				macro.Node.EndPos = p.Pos(body)
+				break
 			}
-			if num > 7 {
-				fmt.Printf("%d:%d %s Error: Syscall can only range from 1-7 got : `%d`\n", token.Row, token.Col, lex.Filename, num)
-				os.Exit(1)
+			depth--
+		}
+		macro.Tokens = append(macro.Tokens, body)
+	}
+	if !ok || p.proc != nil || len(p.expansions) > 0 {
+		return nil
+	}
+	if prev, found := p.Lookup(name.Value); found {
+		p.Redefined(name, "name", prev)
+		return nil
+	}
+	p.Symbols.Macros[name.Value] = macro
+	return macro.Node
+}
+
+// Expand parses the tokens of a macro in place of its name, every expansion
+// produces fresh nodes so labels generated for them never clash.
+func (p *Parser) Expand(token lexer.Token, macro *Macro) ast.Node {
+	node := &ast.Expansion{Pos: p.Pos(token), Macro: macro.Node}
+	for _, site := range p.expansions {
+		if site.Macro == macro.Node {
+			d := diag.New(diag.ERROR, p.Filename, token.Row, token.Col, "Recursive expansion of macro `%s`", macro.Node.Name)
+			def := macro.Node.Pos
+			p.Report(d.WithNote(def.File, def.Row, def.Col, "`%s` defined here", macro.Node.Name))
+			return nil
+		}
+	}
+	if p.expanded++; p.expanded > MAX_EXPANSIONS {
+		if p.expanded == MAX_EXPANSIONS+1 {
+			d := diag.New(diag.ERROR, p.Filename, token.Row, token.Col, "Expansion of macro `%s` exceeds the limit of %d expansions", macro.Node.Name, MAX_EXPANSIONS)
+			def := macro.Node.Pos
+			p.Report(d.WithNote(def.File, def.Row, def.Col, "`%s` defined here", macro.Node.Name))
+		}
+		return nil
+	}
+	if len(p.expansions) >= MAX_EXPANSION_DEPTH {
+		d := diag.New(diag.ERROR, p.Filename, token.Row, token.Col, "Expansion of macro `%s` exceeds the depth limit of %d", macro.Node.Name, MAX_EXPANSION_DEPTH)
+		def := macro.Node.Pos
+		p.Report(d.WithNote(def.File, def.Row, def.Col, "`%s` defined here", macro.Node.Name))
+		return nil
+	}
+
+	filename, tokens, position := p.Filename, p.Tokens, p.Position
+	p.Filename, p.Tokens, p.Position = macro.Filename, macro.Tokens, 0
+	p.expansions = append(p.expansions, node)
+	for !p.AtEnd() {
+		if instr := p.ParseInstr(p.Next()); instr != nil {
+			node.Body = append(node.Body, instr)
+		}
+	}
+	p.expansions = p.expansions[:len(p.expansions)-1]
+	p.Filename, p.Tokens, p.Position = filename, tokens, position
+	return node
+}
+
+// ParseStruct parses `struct Name field type ... end`, a type is a builtin
+// type, `u16`, `u32` or the name of another struct and may be followed by an
+// element count to declare an array. Offsets follow the C layout rules.
+func (p *Parser) ParseStruct(token lexer.Token) ast.Node {
+	if p.AtEnd() {
+		p.Error(token, "Expected struct name")
+		return nil
+	}
+	name := p.Next()
+	ok := name.Kind == lexer.CALL
+	if !ok {
+		p.Error(name, "Expected struct name got `%s` instead", name.Value)
+	}
+
+	node := &ast.Struct{Pos: p.Pos(token), Name: name.Value, Align: 1}
+	for {
+		if p.AtEnd() {
+			p.Error(token, "Missing `end` for struct `%s`", name.Value)
+			return nil
+		}
+		fieldName := p.Next()
+		if fieldName.Kind == lexer.KEYWORD && fieldName.Value == "end" {
+			break
+		}
+		if fieldName.Kind != lexer.CALL {
+			p.Error(fieldName, "Expected field name got `%s` instead", fieldName.Value)
+			ok = false
+			continue
+		}
+		if p.AtEnd() {
+			p.Error(fieldName, "Expected type of field `%s`", fieldName.Value)
+			return nil
+		}
+
+		field := &ast.Field{Pos: p.Pos(fieldName), Name: fieldName.Value}
+		kind := p.Next()
+		size, align := 0, 0
+		if inner, found := p.Symbols.Structs[kind.Value]; found && kind.Kind == lexer.CALL {
+			field.Struct = inner
+			size, align = inner.Size, inner.Align
+		} else if field.Type, field.Width = ast.FieldType(kind.Value); kind.Kind == lexer.CALL && field.Type != ast.VOID {
+			size, align = field.Width, field.Width
+		} else {
+			p.Error(kind, "Expected field type got `%s` instead", kind.Value)
+			ok = false
+			continue
+		}
+
+		next, found := p.Peek()
+		if found && next.Kind == lexer.CALL && p.FieldCount(next) && p.Position+1 < len(p.Tokens) && p.IsFieldType(p.Tokens[p.Position+1]) {
+			p.Error(next, "`%s` after the type of field `%s` is ambiguous, it names a constant and is followed by a type", next.Value, fieldName.Value)
+			ok = false
+		} else if found && p.FieldCount(next) {
+			p.Next()
+			count, _ := p.IntValue(next)
+			if count <= 0 {
+				p.Error(next, "Array field `%s` needs a positive length got `%s`", fieldName.Value, next.Value)
+				ok = false
+				continue
 			}
-			text += "\t## SYSCALL ##\n"
-			for i := num - 1; i >= 0; i-- {
-				text += fmt.Sprintf("\tpop %%%s\n", registers[i])
+			field.Count = int(count)
+			size *= field.Count
+		}
+
+		if prev, found := node.Find(field.Name); found {
+			p.Redefined(fieldName, "field", prev.Pos)
+			ok = false
+			continue
+		}
+		field.Offset = alignTo(node.Size, align)
+		node.Size = field.Offset + size
+		node.Align = max(node.Align, align)
+		node.Fields = append(node.Fields, field)
+	}
+	if !ok {
+		return nil
+	}
+	node.Size = alignTo(node.Size, node.Align)
+
+	if prev, found := p.Lookup(name.Value); found {
+		p.Redefined(name, "name", prev)
+		return nil
+	}
+	p.Symbols.Structs[node.Name] = node
+	return node
+}
+
+// FieldCount reports whether a token after the type of a field is its array
+// length, a number, a `sizeof` or the name of a constant.
+func (p *Parser) FieldCount(token lexer.Token) bool {
+	switch token.Kind {
+	case lexer.INT, lexer.SIZEOF:
+		return true
+	case lexer.CALL:
+		return p.Symbols.Consts[token.Value] != nil
+	}
+	return false
+}
+
+// IsFieldType reports whether a token names a builtin field type or a struct.
+func (p *Parser) IsFieldType(token lexer.Token) bool {
+	if token.Kind != lexer.CALL {
+		return false
+	}
+	if _, found := p.Symbols.Structs[token.Value]; found {
+		return true
+	}
+	kind, _ := ast.FieldType(token.Value)
+	return kind != ast.VOID
+}
+
+func alignTo(offset, align int) int {
+	return (offset + align - 1) / align * align
+}
+
+// Field resolves a `Name.field` path, nested structs are reached by chaining
+// field names. The offset is the sum of the offsets along the path.
+func (p *Parser) Field(token lexer.Token, report bool) (*ast.Field, int, bool) {
+	parts := strings.Split(token.Value, ".")
+	s, ok := p.Symbols.Structs[parts[0]]
+	if !ok {
+		if report {
+			p.UnknownStruct(token)
+		}
+		return nil, 0, false
+	}
+
+	var field *ast.Field
+	offset := 0
+	for _, part := range parts[1:] {
+		if s == nil {
+			if report {
+				p.Error(token, "Field `%s` of `%s` is not a struct", field.Name, token.Value)
 			}
-			text += "\tsyscall\n"
-			text += "\tpush %rax\n"
-		} else if token.Kind == lexer.STRING {
-			text += "\t## STRING ##\n"
-			label, _ := randLabel(9, upper+lower+digits)
-			text += fmt.Sprintf("\tmovq $_%s, %%rax\n", label)
-			text += "\tpush %rax\n"
-			data += fmt.Sprintf("\t_%s: .asciz \"%s\"\n", label, token.Value)
-		} else if token.Kind == lexer.IMPORT {
-			text += fmt.Sprintf("\t## IMPORT %s ##\n", token.Value)
-			parts := strings.Split(token.Value, ".")
-			if len(parts) == 0 {
-				fmt.Printf("%d:%d %s Error: Import statement missing library\n", token.Row, token.Col, lex.Filename)
-				os.Exit(1)
+			return nil, 0, false
+		}
+		field, ok = s.Find(part)
+		if !ok {
+			if report {
+				p.Error(token, "Struct `%s` has no field `%s`", s.Name, part)
 			}
-			libPath := filepath.Join(xylHome, "lib", filepath.Join(parts...)) + ".xyl"
-			if _, err := os.Stat(libPath); os.IsNotExist(err) {
-				pwd, err := os.Getwd()
-				if err != nil {
-					fmt.Printf("%d:%d %s Error: Imported library could not be found : `%s`\n", token.Row, token.Col, lex.Filename, token.Value)
-					os.Exit(1)
-				}
-				modulePath := filepath.Join(pwd, filepath.Join(parts...)) + ".xyl"
-				if _, err := os.Stat(modulePath); os.IsNotExist(err) {
-					fmt.Printf("%d:%d %s Error: Imported library could not be found : `%s`\n", token.Row, token.Col, lex.Filename, token.Value)
-					os.Exit(1)
-				}
-				libPath = modulePath
+			return nil, 0, false
+		}
+		offset += field.Offset
+		s = field.Struct
+	}
+	return field, offset, true
+}
+
+func (p *Parser) UnknownStruct(token lexer.Token) {
+	name, _, _ := strings.Cut(token.Value, ".")
+	p.Error(token, "Unknown struct `%s`", name)
+}
+
+// ParseField turns `Name.field` into its offset, `Name.field @` into a load
+// and `Name.field :=` into a store through the pointer on the stack.
+func (p *Parser) ParseField(token lexer.Token) ast.Node {
+	pos := p.Pos(token)
+	field, offset, ok := p.Field(token, true)
+	next, found := p.Peek()
+	access := found && next.Kind == lexer.OPERATOR && (next.Value == "@" || next.Value == ":=")
+	if access {
+		p.Next()
+	}
+	if !ok {
+		return nil
+	}
+	if !access {
+		return &ast.Literal{Pos: pos, Kind: ast.INT_LIT, Value: strconv.Itoa(offset)}
+	}
+	if !field.Scalar() {
+		p.Error(next, "Field `%s` is not a scalar, use its offset `%s` to get its address", field.Name, token.Value)
+		return nil
+	}
+	if next.Value == "@" {
+		return &ast.FieldLoad{Pos: pos, Name: token.Value, Field: field, Offset: offset}
+	}
+	return &ast.FieldStore{Pos: pos, Name: token.Value, Field: field, Offset: offset}
+}
+
+// ParseVar parses `var NAME TYPE` with an optional `= VALUE` initializer,
+// the value has to be a literal or a constant.
+func (p *Parser) ParseVar(token lexer.Token) ast.Node {
+	if p.Position+1 >= len(p.Tokens) {
+		p.Error(token, "Not enough arguments for var")
+		p.Position = len(p.Tokens)
+		return nil
+	}
+
+	name := p.Next()
+	kind := p.Next()
+	if name.Kind != lexer.CALL {
+		p.Error(name, "Expected variable name got `%s` instead", name.Value)
+		return nil
+	}
+	node := &ast.Var{Pos: p.Pos(token), Name: name.Value, Type: ast.ParseType(kind.Value)}
+	if kind.Kind != lexer.CALL || node.Type == ast.VOID {
+		p.Error(kind, "Expected variable type got `%s` instead", kind.Value)
+		return nil
+	}
+
+	if next, ok := p.Peek(); ok && next.Kind == lexer.OPERATOR && next.Value == "=" {
+		p.Next()
+		if p.AtEnd() {
+			p.Error(next, "Expected initial value of `%s`", name.Value)
+			return nil
+		}
+		value := p.Next()
+		init, ok := p.VarInit(node.Type, value)
+		if !ok {
+			p.Error(value, "Invalid initial value for %s variable `%s` : `%s`", node.Type, name.Value, value.Value)
+			return nil
+		}
+		node.HasInit, node.Init = true, init
+	}
+
+	if prev, ok := p.Lookup(name.Value); ok {
+		p.Redefined(name, "name", prev)
+		return nil
+	}
+	p.Symbols.Vars[node.Name] = node
+	return node
+}
+
+func (p *Parser) VarInit(kind ast.Type, token lexer.Token) (int64, bool) {
+	switch kind {
+	case ast.BOOL:
+		if token.Kind == lexer.BOOL {
+			if token.Value == "true" {
+				return 1, true
 			}
-			if !strContains(libs, libPath) {
-				l, err := lexer.NewLexer(libPath, true, lex.Clean)
-				if err != nil {
-					fmt.Printf("Could not compile lib `%s`\n%s\n", libPath, err.Error())
-					os.Exit(1)
-				}
+			return 0, true
+		}
+		return 0, false
+	case ast.CHAR:
+		if token.Kind == lexer.CHAR {
+			value, err := strconv.ParseInt(token.Value, 10, 64)
+			return value, err == nil
+		}
+		value, ok := p.IntValue(token)
+		return value, ok && -128 <= value && value <= 255
+	}
+	return p.IntValue(token)
+}
 
-				l.Lex()
-				libText, libData, libBss, libFunctions, newLibs, newBuffers := Parse(*l, libs)
-				text += libText
-				data += libData
-				bss += libBss
-				for _, fn := range libFunctions {
-					if contains(functions, fn) {
-						fmt.Printf("Duplicate function `%s` imported\n", fn.Name)
-						os.Exit(1)
-					}
-				}
-				for _, buf := range newBuffers {
-					if strContains(buffers, buf) {
-						fmt.Printf("Duplicate buffer `%s` imported\n", buf)
-						os.Exit(1)
-					}
-				}
-				functions = append(functions, libFunctions...)
-				buffers = append(buffers, newBuffers...)
-				libs = newLibs
-				libs = append(libs, libPath)
+// Store consumes a `:=` following a variable, local or argument name which
+// turns the name into an assignment.
+func (p *Parser) Store() bool {
+	if next, ok := p.Peek(); ok && next.Kind == lexer.OPERATOR && next.Value == ":=" {
+		p.Next()
+		return true
+	}
+	return false
+}
+
+// ParseLet parses `let a b in ... end`, every local gets its own frame slot
+// for the duration of the body and the slots are reused after `end`.
+func (p *Parser) ParseLet(token lexer.Token) ast.Node {
+	if p.proc == nil {
+		p.Error(token, "`let` outside of a procedure")
+	}
+
+	node := &ast.Let{Pos: p.Pos(token)}
+	depth := len(p.locals)
+	for {
+		if p.AtEnd() {
+			p.Error(token, "Missing `in` for `let` instruction")
+			return nil
+		}
+		name := p.Next()
+		if name.Kind == lexer.KEYWORD && name.Value == "in" {
+			break
+		}
+		if name.Kind != lexer.CALL {
+			p.Error(name, "Expected local name got `%s` instead", name.Value)
+			continue
+		}
+		for _, local := range node.Locals {
+			if local.Name == name.Value {
+				p.Redefined(name, "local", local.Pos)
 			}
-			text += fmt.Sprintf("\t## FILE %s ##\n", lex.Filename)
-		} else if token.Kind == lexer.PROC {
-			// TODO: Make sure the user cant use reserved keywords
-			text += "## PROC ##\n"
-			text += fmt.Sprintf("%s:\n", token.Value)
-			text += "\tpush %rbp\n"
-			text += "\tmovq %rsp, %rbp\n"
-			ifQueue = append(ifQueue, Label{token.Value, false, false, true})
-			args := make(map[string]int)
-			var index int
-			for {
-				i++
-				newTok := lex.Tokens[i]
-				if newTok.Kind == lexer.VOID_ARG {
-					break
-				} else {
-					switch newTok.Kind {
-					case lexer.BOOL_ARG, lexer.CHAR_ARG, lexer.INT_ARG, lexer.PTR_ARG:
-						if _, ok := args[newTok.Value]; ok {
-							fmt.Printf("%d:%d %s Error: Duplicate argument name : `%s`\n", newTok.Row, newTok.Col, lex.Filename, newTok.Value)
-							os.Exit(1)
-						}
-						args[newTok.Value] = index
-					default:
-						fmt.Printf("%d:%d %s Error: Unknown argument : `%s`\n", newTok.Row, newTok.Col, lex.Filename, newTok.Value)
-						os.Exit(1)
-					}
-				}
-				index++
+		}
+		local := &ast.Local{Pos: p.Pos(name), Name: name.Value, Slot: len(p.locals)}
+		node.Locals = append(node.Locals, local)
+		p.locals = append(p.locals, local)
+	}
+	if len(node.Locals) == 0 {
+		p.Error(token, "`let` needs at least one name")
+	}
+	if p.proc != nil {
+		p.proc.Frame = max(p.proc.Frame, len(p.locals))
+	}
+
+	var end lexer.Token
+	node.Body, end = p.ParseBlock(token, "end")
+	node.EndPos = p.Pos(end)
+	p.locals = p.locals[:depth]
+	return node
+}
+
+// ParseBuffer parses `buffer name size` for a block of bytes and
+// `buffer name type count` for a typed array.
+func (p *Parser) ParseBuffer(token lexer.Token) ast.Node {
+	if p.Position+1 >= len(p.Tokens) {
+		p.Error(token, "Not enough arguments for buffer")
+		p.Position = len(p.Tokens)
+		return nil
+	}
+
+	name := p.Next()
+	size := p.Next()
+	if name.Kind != lexer.CALL {
+		p.Error(name, "Expected buffer name got `%s` instead", name.Value)
+		return nil
+	}
+	buffer := &ast.Buffer{Pos: p.Pos(token), Name: name.Value}
+	if kind := ast.ParseType(size.Value); size.Kind == lexer.CALL && kind != ast.VOID {
+		if p.AtEnd() {
+			p.Error(size, "Expected array length of `%s`", name.Value)
+			return nil
+		}
+		buffer.Type = kind
+		size = p.Next()
+	}
+	value, ok := p.IntValue(size)
+	if !ok {
+		p.Error(size, "Expected buffer size got `%s` instead", size.Value)
+		return nil
+	}
+	if value < 0 {
+		p.Error(size, "Buffer size can not be negative : `%d`", value)
+		return nil
+	}
+	if prev, ok := p.Lookup(name.Value); ok {
+		p.Redefined(name, "name", prev)
+		return nil
+	}
+
+	buffer.Size = int(value)
+	if buffer.Type != ast.VOID {
+		buffer.Count = int(value)
+		buffer.Size = buffer.Count * buffer.Type.Size()
+	}
+	p.Symbols.Buffers[name.Value] = buffer
+	return buffer
+}
+
+// ParseIndex parses `[]` and `[]=`, the array is only known once the checker
+// has followed the pointer operand back to the name of a typed array.
+func (p *Parser) ParseIndex(token lexer.Token) ast.Node {
+	if token.Value == "[]=" {
+		return &ast.IndexStore{Pos: p.Pos(token)}
+	}
+	return &ast.Index{Pos: p.Pos(token)}
+}
+
+// ParseAsm parses `asm int int -> int "..." end`, the types before `->` are
+// consumed from the stack and the ones after it are produced, every string
+// is one line of assembly.
+func (p *Parser) ParseAsm(token lexer.Token) ast.Node {
+	if p.proc == nil {
+		p.Error(token, "`asm` outside of a procedure")
+	}
+
+	node := &ast.Asm{Pos: p.Pos(token)}
+	outputs := false
+	for {
+		if p.AtEnd() {
+			p.Error(token, "Missing `end` for `asm` instruction")
+			return nil
+		}
+		next := p.Next()
+		switch {
+		case next.Kind == lexer.KEYWORD && next.Value == "end":
+			if len(node.Code) == 0 {
+				p.Error(token, "`asm` block without any assembly")
 			}
-			functions = append(functions, Function{token.Value, args})
-			funcQueue = append(funcQueue, Function{token.Value, args})
-		} else if token.Kind == lexer.KEYWORD {
-			switch token.Value {
-			case "dup":
-				text += "\t## DUP ##\n"
-				text += "\tpop %rax\n"
-				text += "\tpush %rax\n"
-				text += "\tpush %rax\n"
-			case "drop":
-				text += "\t## DROP ##\n"
-				text += "\tpop %rax\n"
-			case "swap":
-				text += "\t## SWAP ##\n"
-				text += "\tpop %rax\n"
-				text += "\tpop %rbx\n"
-				text += "\tpush %rax\n"
-				text += "\tpush %rbx\n"
-			case "inc":
-				text += "\t## INC ##\n"
-				text += "\tpop %rax\n"
-				text += "\tinc %rax\n"
-				text += "\tpush %rax\n"
-			case "dec":
-				text += "\t## DEC ##\n"
-				text += "\tpop %rax\n"
-				text += "\tsub %rax\n"
-				text += "\tpush %rax\n"
-			case "dump":
-				text += "\t## DUMP ##\n"
-				text += "\tpop %rdi\n"
-				text += "\tcall dump\n"
-			case "if":
-				label, _ := randLabel(10, upper+lower+digits)
-				text += "\t## IF ##\n"
-				text += "\tpop %rax\n"
-				text += "\ttest %rax, %rax\n"
-				text += fmt.Sprintf("\tje else_%s\n", label)
-				ifQueue = append(ifQueue, Label{label, false, false, false})
-			case "else":
-				if len(ifQueue) < 1 || ifQueue[len(ifQueue)-1].HasElse {
-					fmt.Printf("%d:%d %s Error: Could not find reference for `else` instruction\n", token.Row, token.Col, lex.Filename)
-					os.Exit(1)
-				}
-				ifQueue[len(ifQueue)-1].HasElse = true
-				label := ifQueue[len(ifQueue)-1].Name
-				text += "\t## ELSE ##\n"
-				text += fmt.Sprintf("\tjmp end_%s\n", label)
-				text += fmt.Sprintf("else_%s:\n", label)
-			case "end":
-				if len(ifQueue) < 1 {
-					fmt.Printf("%d:%d %s Error: Could not find reference for `end` instruction\n", token.Row, token.Col, lex.Filename)
-					os.Exit(1)
-				}
-				text += "\t## END ##\n"
-				label := ifQueue[len(ifQueue)-1].Name
-				if !ifQueue[len(ifQueue)-1].IsFunc {
-					if ifQueue[len(ifQueue)-1].IsWhile {
-						text += fmt.Sprintf("\tjmp while_%s\n", label)
-					} else {
-						if !ifQueue[len(ifQueue)-1].HasElse {
-							text += fmt.Sprintf("else_%s:\n", label)
-						}
-					}
-					text += fmt.Sprintf("end_%s:\n", label)
-				} else {
-					text += "\tpop %rax\n"
-					text += "\tmov %rbp, %rsp\n"
-					text += "\tpop %rbp\n"
-					text += "\tret\n"
-					if len(funcQueue) > 1 {
-						funcQueue = funcQueue[:len(funcQueue)-1]
-					}
-				}
-				ifQueue = ifQueue[:len(ifQueue)-1]
-			case "while":
-				label, _ := randLabel(7, upper+lower+digits)
-				text += "\t## WHILE ##\n"
-				text += fmt.Sprintf("while_%s:\n", label)
-				ifQueue = append(ifQueue, Label{label, false, true, false})
-			case "do":
-				if len(ifQueue) < 1 {
-					fmt.Printf("%d:%d %s Error: Could not find reference for `do` instruction\n", token.Row, token.Col, lex.Filename)
-					os.Exit(1)
-				}
-				label := ifQueue[len(ifQueue)-1].Name
-				text += "\t## DO ##\n"
-				text += "\tpop %rax\n"
-				text += "\ttest %rax, %rax\n"
-				text += fmt.Sprintf("\tje end_%s\n", label)
-			case "return":
-				text += "\t## RETURN ##\n"
-				text += "\tpop %rax\n"
-				text += "\tmov %rbp, %rsp\n"
-				text += "\tpop %rbp\n"
-				text += "\tret\n"
-			case "derefc":
-				text += "\t## DEREFC ##\n"
-				text += "\tpop %rax\n"
-				text += "\txor %rbx, %rbx\n"
-				text += "\tmov (%rax), %bl\n"
-				text += "\tpush %rbx\n"
-			case "derefi":
-				text += "\t## DEREFI ##\n"
-				text += "\tpop %rax\n"
-				text += "\tmov (%rax), %rbx\n"
-				text += "\tpush %rbx\n"
-			case "buffer":
-				if i+2 < len(lex.Tokens) {
-					name := lex.Tokens[i+1]
-					size := lex.Tokens[i+2]
-					if name.Kind != lexer.CALL {
-						fmt.Printf("%d:%d %s Error: Expected buffer name got `%s` instead\n", name.Row, name.Col, lex.Filename, name.Value)
-						os.Exit(1)
-					} else if size.Kind != lexer.INT {
-						fmt.Printf("%d:%d %s Error: Expected buffer size got `%s` instead\n", size.Row, size.Col, lex.Filename, size.Value)
-						os.Exit(1)
-					}
-					bss += fmt.Sprintf("%s:\n", name.Value)
-					bss += fmt.Sprintf("\t.space %s\n", size.Value)
-					buffers = append(buffers, name.Value)
-					i += 2
-				} else {
-					fmt.Printf("%d:%d %s Error: Not enough arguments for buffer\n", token.Row, token.Col, lex.Filename)
-					os.Exit(1)
-				}
+			return node
+		case next.Kind == lexer.STRING:
+			node.Code = append(node.Code, next.Value)
+		case len(node.Code) > 0:
+			p.Error(next, "Expected assembly string or `end` got `%s` instead", next.Value)
+		case next.Kind == lexer.OPERATOR && next.Value == "->":
+			if outputs {
+				p.Error(next, "Duplicate `->` in `asm` stack effect")
 			}
-		} else if token.Kind == lexer.CALL {
-			if containsStr(functions, token.Value) {
-				text += fmt.Sprintf("\t## CALL %s ##\n", token.Value)
-				text += fmt.Sprintf("\tcall %s\n", token.Value)
-				for range len(findFunc(functions, token.Value).Args) {
-					text += "\tpop %rbx\n"
-				}
-				text += "\tpush %rax\n"
-			} else {
-				if strContains(buffers, token.Value) {
-					text += "\t## GET BUFFER ##\n"
-					text += fmt.Sprintf("\tmovq $%s, %%rax\n", token.Value)
-					text += "\tpush %rax\n"
-				} else {
-					if len(funcQueue) > 0 {
-						if _, ok := funcQueue[len(funcQueue)-1].Args[token.Value]; ok {
-							text += fmt.Sprintf("\t## GET ARG %s ##\n", token.Value)
-							offset := (len(funcQueue[len(funcQueue)-1].Args) - 1) - funcQueue[len(funcQueue)-1].Args[token.Value]
-							text += "\tmovq %rbp, %rax\n"
-							text += fmt.Sprintf("\tadd $%d, %%rax\n", offset*8+16)
-							text += "\tmovq (%rax), %rbx\n"
-							text += "\tpush %rbx\n"
-						} else {
-							fmt.Printf("%d:%d %s Error: Unknown argument `%s`\n", token.Row, token.Col, lex.Filename, token.Value)
-							os.Exit(1)
-						}
-					} else {
-						fmt.Printf("%d:%d %s Error: Unknown keyword `%s`\n", token.Row, token.Col, lex.Filename, token.Value)
-						os.Exit(1)
-					}
-				}
+			outputs = true
+		case next.Kind == lexer.CALL && ast.ParseType(next.Value) != ast.VOID:
+			effect := &node.Args
+			if outputs {
+				effect = &node.Returns
 			}
+			if len(*effect) == ast.MAX_RETURNS {
+				p.Error(next, "`asm` can take and leave at most %d values", ast.MAX_RETURNS)
+				continue
+			}
+			*effect = append(*effect, ast.ParseType(next.Value))
+		default:
+			p.Error(next, "Expected type or assembly string got `%s` instead", next.Value)
 		}
 	}
+}
 
-	var code string
-	if !lex.IsLib {
-		code = fmt.Sprintf(".section .data\n%s\n.section .bss\n%s\n.section .text\n\t.global _start\n%s\n%s\n_start:\n\tcall main\n\tpush %%rax\n\tmovq $60, %%rax\n\tpop %%rdi\n\tsyscall\n", data, bss, printNumText, text)
-	} else {
-		return text, data, bss, functions, libs, buffers
+// ParseIf parses `if ... end` with optional `elif cond do ...` branches and
+// a final `else`, the `do` of an `elif` opens the nested If.
+func (p *Parser) ParseIf(token lexer.Token) ast.Node {
+	node := &ast.If{Pos: p.Pos(token), Elif: token.Value == "do"}
+	var end lexer.Token
+	node.Then, end = p.ParseBlock(token, "elif", "else", "end")
+	switch end.Value {
+	case "elif":
+		node.HasElse = true
+		node.ElsePos = p.Pos(end)
+		cond, do := p.ParseBlock(end, "do")
+		node.Else = cond
+		if do.Value != "do" {
+			node.EndPos = p.Pos(do)
+			return node
+		}
+		elif := p.ParseIf(do).(*ast.If)
+		node.Else = append(node.Else, elif)
+		node.EndPos = elif.EndPos
+		return node
+	case "else":
+		node.HasElse = true
+		node.ElsePos = p.Pos(end)
+		node.Else, end = p.ParseBlock(end, "end")
 	}
+	node.EndPos = p.Pos(end)
+	return node
+}
 
-	baseName := filepath.Base(lex.Filename)
-	ext := filepath.Ext(lex.Filename)
+func (p *Parser) ParseWhile(token lexer.Token) ast.Node {
+	node := &ast.While{Pos: p.Pos(token)}
+	var do lexer.Token
+	node.Cond, do = p.ParseBlock(token, "do")
+	node.DoPos = p.Pos(do)
+	var end lexer.Token
+	p.loops = append(p.loops, node)
+	node.Body, end = p.ParseBlock(do, "end")
+	p.loops = p.loops[:len(p.loops)-1]
+	node.EndPos = p.Pos(end)
+	return node
+}
 
-	fileName := baseName[:len(baseName)-len(ext)]
-	fileOut := fileName + ".asm"
-	err := os.WriteFile(fileOut, []byte(code), 0644)
-	if err != nil {
-		fmt.Printf("Error: %s\n", err)
-		os.Exit(1)
+// ParseFor parses `for i start end do ... end` and the variant with
+// `step N` before `do`, the instructions before `do` push the bounds and the
+// step has to be a non zero integer or constant that fits in 32 bits.
+func (p *Parser) ParseFor(token lexer.Token) ast.Node {
+	if p.proc == nil {
+		p.Error(token, "`for` outside of a procedure")
+	}
+	if p.AtEnd() {
+		p.Error(token, "Expected name of the `for` variable")
+		return nil
+	}
+	name := p.Next()
+	if name.Kind != lexer.CALL {
+		p.Error(name, "Expected name of the `for` variable got `%s` instead", name.Value)
 	}
 
-	as := exec.Command("as", "-o", fileName+".o", fileOut)
-	output, err := as.Output()
-	if err != nil {
-		fmt.Println("Error while compiling ", fileOut)
-		fmt.Println(output)
-		fmt.Println(err)
-		os.Exit(1)
+	node := &ast.For{Pos: p.Pos(token), Step: 1}
+	bounds, do := p.ParseBlock(token, "step", "do")
+	node.Bounds = bounds
+	if do.Value == "step" {
+		if p.AtEnd() {
+			p.Error(do, "Expected step of `for` loop")
+			return nil
+		}
+		value := p.Next()
+		step, ok := p.IntValue(value)
+		if !ok || step == 0 {
+			p.Error(value, "Step of `for` must be a non zero integer got `%s`", value.Value)
+		} else if step != int64(int32(step)) {
+			p.Error(value, "Step of `for` must fit in 32 bits got `%s`", value.Value)
+		}
+		node.Step = step
+		if next, found := p.Peek(); !found || next.Kind != lexer.KEYWORD || next.Value != "do" {
+			p.Error(do, "Missing `do` for `for` instruction")
+			return nil
+		}
+		do = p.Next()
 	}
+	if do.Value != "do" {
+		return nil
+	}
+	node.DoPos = p.Pos(do)
 
-	ld := exec.Command("ld", "-o", fileName, fileName+".o")
-	output, err = ld.Output()
-	if err != nil {
-		fmt.Println("Error while linking ", fileName, ".o")
-		fmt.Println(output)
-		fmt.Println(err)
-		os.Exit(1)
+	depth := len(p.locals)
+	node.End = &ast.Local{Pos: p.Pos(token), Slot: depth}
+	node.Var = &ast.Local{Pos: p.Pos(name), Name: name.Value, Slot: depth + 1}
+	p.locals = append(p.locals, node.End, node.Var)
+	if p.proc != nil {
+		p.proc.Frame = max(p.proc.Frame, len(p.locals))
 	}
 
-	if lex.Clean {
-		err = os.Remove(fileOut)
-		if err != nil {
-			fmt.Println("Error while removing ", fileOut)
-			fmt.Println(err)
-			os.Exit(1)
+	var end lexer.Token
+	p.loops = append(p.loops, node)
+	node.Body, end = p.ParseBlock(do, "end")
+	p.loops = p.loops[:len(p.loops)-1]
+	p.locals = p.locals[:depth]
+	node.EndPos = p.Pos(end)
+	if name.Kind != lexer.CALL {
+		return nil
+	}
+	return node
+}
+
+// ParseMatch parses `match case 1 ... case 2 ... default ... end`, case
+// values are integers, characters or constants and may not repeat.
+func (p *Parser) ParseMatch(token lexer.Token) ast.Node {
+	node := &ast.Match{Pos: p.Pos(token)}
+	body, term := p.ParseBlock(token, "case", "default", "end")
+	if len(body) > 0 {
+		p.Error(token, "Instructions between `match` and its first `case`")
+	}
+
+	for term.Value == "case" {
+		if p.AtEnd() {
+			p.Error(term, "Expected value of `case`")
+			return nil
+		}
+		value := p.Next()
+		c := &ast.Case{Pos: p.Pos(term)}
+		var ok bool
+		if value.Kind == lexer.CHAR {
+			c.Value, _ = strconv.ParseInt(value.Value, 10, 64)
+			ok = true
+		} else {
+			c.Value, ok = p.IntValue(value)
+		}
+		if !ok {
+			p.Error(value, "Expected integer value of `case` got `%s` instead", value.Value)
+		}
+		for _, prev := range node.Cases {
+			if ok && prev.Value == c.Value {
+				d := diag.New(diag.ERROR, p.Filename, value.Row, value.Col, "Duplicate case value : `%d`", c.Value)
+				p.Report(d.WithNote(prev.File, prev.Row, prev.Col, "`%d` first handled here", c.Value))
+				ok = false
+			}
 		}
 
-		err = os.Remove(fileName + ".o")
-		if err != nil {
-			fmt.Println("Error while removing ", fileName, ".o")
-			fmt.Println(err)
-			os.Exit(1)
+		c.Body, term = p.ParseBlock(term, "case", "default", "end")
+		if ok {
+			node.Cases = append(node.Cases, c)
 		}
 	}
+	if term.Value == "default" {
+		node.HasDefault = true
+		node.DefaultPos = p.Pos(term)
+		node.Default, term = p.ParseBlock(term, "end")
+	} else if term.Value == "end" {
+		p.Report(diag.New(diag.WARNING, node.File, node.Row, node.Col, "`match` without `default` does nothing for unhandled values"))
+	}
+	node.EndPos = p.Pos(term)
+	return node
+}
 
-	return "", "", "", []Function{}, []string{}, []string{}
+// CheckDivisor reports a division whose divisor is a literal zero pushed
+// right before the operator.
+func (p *Parser) CheckDivisor(token lexer.Token) {
+	if p.Position < 2 {
+		return
+	}
+	prev := p.Tokens[p.Position-2]
+	if prev.Kind != lexer.INT && prev.Kind != lexer.CALL {
+		return
+	}
+	if value, ok := p.IntValue(prev); ok && value == 0 {
+		p.Error(token, "Division by zero in `%s`", token.Value)
+	}
+}
+
+func (p *Parser) ParseInstr(token lexer.Token) ast.Node {
+	pos := p.Pos(token)
+	switch token.Kind {
+	case lexer.INT:
+		return &ast.Literal{Pos: pos, Kind: ast.INT_LIT, Value: token.Value}
+	case lexer.BOOL:
+		return &ast.Literal{Pos: pos, Kind: ast.BOOL_LIT, Value: token.Value}
+	case lexer.STRING:
+		return &ast.Literal{Pos: pos, Kind: ast.STRING_LIT, Value: token.Value}
+	case lexer.CHAR:
+		return &ast.Literal{Pos: pos, Kind: ast.CHAR_LIT, Value: token.Value}
+	case lexer.OPERATOR:
+		if token.Value == "@" {
+			p.Error(token, "`@` must follow the name of a variable")
+			return nil
+		}
+		if token.Value == "/" || token.Value == "%" {
+			p.CheckDivisor(token)
+		}
+		if token.Value == "[]" || token.Value == "[]=" {
+			return p.ParseIndex(token)
+		}
+		if token.Value == ":=" {
+			p.Error(token, "`:=` must follow the name of a variable, local or argument")
+			return nil
+		}
+		if token.Value == "->" {
+			p.Error(token, "`->` is only allowed in procedure signatures and `asm` blocks")
+			return nil
+		}
+		return &ast.Operator{Pos: pos, Op: token.Value}
+	case lexer.SYSCALL:
+		num, ok := p.IntValue(token)
+		if !ok {
+			p.Error(token, "Invalid number : `%s`", token.Value)
+			return nil
+		}
+		if num < 1 || num > 7 {
+			p.Error(token, "Syscall can only range from 1-7 got : `%d`", num)
+			return nil
+		}
+		return &ast.Syscall{Pos: pos, Argc: int(num)}
+	case lexer.KEYWORD:
+		switch token.Value {
+		case "if":
+			return p.ParseIf(token)
+		case "while":
+			return p.ParseWhile(token)
+		case "for":
+			return p.ParseFor(token)
+		case "match":
+			return p.ParseMatch(token)
+		case "buffer":
+			return p.ParseBuffer(token)
+		case "const":
+			return p.ParseConst(token)
+		case "var":
+			return p.ParseVar(token)
+		case "struct":
+			return p.ParseStruct(token)
+		case "macro":
+			return p.ParseMacro(token)
+		case "asm":
+			return p.ParseAsm(token)
+		case "let":
+			return p.ParseLet(token)
+		case "return":
+			if p.proc == nil {
+				p.Error(token, "`return` outside of a procedure")
+				return nil
+			}
+			return &ast.Return{Pos: pos}
+		case "break", "continue":
+			if len(p.loops) == 0 {
+				p.Error(token, "`%s` outside of a loop", token.Value)
+				return nil
+			}
+			loop := p.loops[len(p.loops)-1]
+			if token.Value == "break" {
+				return &ast.Break{Pos: pos, Loop: loop}
+			}
+			return &ast.Continue{Pos: pos, Loop: loop}
+		case "divmod":
+			p.CheckDivisor(token)
+		case "else", "elif", "do", "end", "in", "case", "default":
+			p.Error(token, "Could not find reference for `%s` instruction", token.Value)
+			return nil
+		}
+		return &ast.Keyword{Pos: pos, Name: token.Value}
+	case lexer.CALL:
+		for i := len(p.locals) - 1; i >= 0; i-- {
+			if local := p.locals[i]; local.Name == token.Value {
+				if p.Store() {
+					return &ast.LocalStore{Pos: pos, Local: local}
+				}
+				return &ast.LocalRef{Pos: pos, Local: local}
+			}
+		}
+		if macro, ok := p.Symbols.Macros[token.Value]; ok {
+			return p.Expand(token, macro)
+		}
+		if proc, ok := p.Symbols.Functions[token.Value]; ok {
+			return &ast.Call{Pos: pos, Name: token.Value, Proc: proc}
+		}
+		if buffer, ok := p.Symbols.Buffers[token.Value]; ok {
+			return &ast.BufferRef{Pos: pos, Name: token.Value, Buffer: buffer}
+		}
+		if c, ok := p.Symbols.Consts[token.Value]; ok {
+			return &ast.Literal{Pos: pos, Kind: ast.INT_LIT, Value: strconv.FormatInt(c.Value, 10)}
+		}
+		if v, ok := p.Symbols.Vars[token.Value]; ok {
+			if next, ok := p.Peek(); ok && next.Kind == lexer.OPERATOR && next.Value == "@" {
+				p.Next()
+				return &ast.VarLoad{Pos: pos, Var: v}
+			}
+			if p.Store() {
+				return &ast.VarStore{Pos: pos, Var: v}
+			}
+			return &ast.VarRef{Pos: pos, Var: v}
+		}
+		if p.proc == nil {
+			p.Error(token, "Unknown keyword `%s`", token.Value)
+			return nil
+		}
+		index, ok := p.proc.ArgIndex(token.Value)
+		if !ok {
+			p.Error(token, "Unknown argument `%s`", token.Value)
+			return nil
+		}
+		if p.Store() {
+			return &ast.ArgStore{Pos: pos, Name: token.Value, Index: index}
+		}
+		return &ast.ArgRef{Pos: pos, Name: token.Value, Index: index}
+	case lexer.FIELD:
+		return p.ParseField(token)
+	case lexer.SIZEOF:
+		size, ok := p.IntValue(token)
+		if !ok {
+			p.UnknownStruct(token)
+			return nil
+		}
+		return &ast.Literal{Pos: pos, Kind: ast.INT_LIT, Value: strconv.FormatInt(size, 10)}
+	case lexer.IMPORT:
+		p.Error(token, "`import` is only allowed at the top level")
+		return nil
+	case lexer.PROC:
+		p.Error(token, "`proc` is only allowed at the top level")
+		p.ParseProc(token)
+		return nil
+	}
+	p.Error(token, "Unexpected token : `%s`", token.Value)
+	return nil
 }
@@ -2,17 +2,17 @@ if exists("b:current_syntax")
   finish
 endif
 
-syn keyword xylKeyword dup drop swap inc dec dump return if end else syscall while do derefc derefi proc in buffer
-syn keyword xylType int char bool ptr
+syn keyword xylKeyword dup drop swap inc dec dump return if end else elif syscall while for step match case default do break continue derefc derefw derefd derefi storec storew stored storei proc in buffer const var struct macro asm let divmod neg and or not sizeof
+syn keyword xylType int char bool ptr void
 syn keyword xylBoolean true false
 
 syn region xylCharacter start=+'+ skip=+\\\\\|\\'+ end=+'+
-syn region xylString start=+"+ skip=+\\\\\|\\'+ end=+"+ contains=xylEscape
+syn region xylString start=+"+ skip=+\\\\\|\\"+ end=+"+ contains=xylEscape
 
-syn match xylEscape "\\\\.\|\\[nrtbf\"']"
+syn match xylEscape "\\[nrt0\\\"']\|\\x\x\x"
 syn match xylImportKeyword "import"
-syn match xylNumber "\<\d\+"
-syn match xylOperator "[+\-*/<>=!]"
+syn match xylNumber "-\=\<\(0[xX][0-9a-fA-F_]\+\|0[bB][01_]\+\|0[oO][0-7_]\+\|\d[0-9_]*\)\>"
+syn match xylOperator "[+\-*/%<>=!&|^~@]\|\[\]=\=\|:="
 
 syn match xylTodo "TODO"
 syn match xylNote "NOTE"
@@ -22,6 +22,9 @@ syn match xylHack "HACK"
 syn match xylCommentNote "@\<\w\+\>" contained display
 
 syn region xylComment start=/#/ end=/$/ contains=xylCommentNote,xylTodo,xylNote,xylXXX,xylFixMe,xylHack
+syn match xylDirective "#if\s\+[^ \t#]\+\s*\(#.*\)\=$" contains=xylDirectiveComment
+syn match xylDirective "#\(else\|end\)\s*\(#.*\)\=$" contains=xylDirectiveComment
+syn match xylDirectiveComment "\s#.*$" contained
 
 hi def link xylTodo Todo
 hi def link xylNote Todo
@@ -38,5 +41,7 @@ hi def link xylImportKeyword PreProc
 hi def link xylNumber Number
 hi def link xylOperator Operator
 hi def link xylComment Comment
+hi def link xylDirective PreProc
+hi def link xylDirectiveComment Comment
 
 let b:current_syntax = "xylia"